@@ -8,7 +8,9 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/nknorg/nkn-sdk-go"
 	"github.com/spf13/viper"
@@ -18,21 +20,109 @@ import (
 const SEEDRPCSERVERADDR = "http://178.128.136.86:30003"
 const IDENTIFIER = "nkn-link"
 const DefaultMTU = 1420
+const DefaultBatchDelay = 2 * time.Millisecond
+const DefaultMaxMessageSize = 2048
+const DefaultFragmentTimeout = 5 * time.Second
+const DefaultFragmentMemoryLimit = 4 << 20
+const DefaultKeepaliveInterval = 10 * time.Second
+const DefaultKeepaliveTimeout = 30 * time.Second
+
+// transport modes
+const (
+	TransportModeMessage = "message" // raw NKN messages, unreliable like UDP
+	TransportModeSession = "session" // reliable NKN sessions with transmission and congestion control
+)
+
+// modes
+const (
+	ModePeer   = "peer"   // point-to-point link between configured peers
+	ModeServer = "server" // leases addresses from a pool to connecting clients
+	ModeClient = "client" // configures the TUN device from the lease of a server
+	ModeMesh   = "mesh"   // learns the other nodes of a mesh from announcements
+)
+
+// default route modes
+const (
+	DefaultRouteModeMetric = "metric" // the previous default route is moved to a higher metric
+	DefaultRouteModePolicy = "policy" // a dedicated routing table selected by ip rules, sockets of NKN are marked to bypass it
+)
+
+// DefaultRouteTable is the routing table of the tunnel and DefaultFwmark the
+// mark of the NKN sockets in the policy default route mode.
+const DefaultRouteTable = 0x6e6b
+const DefaultFwmark = 0x6e6b
+
+const DefaultLeaseFile = "leases.json"
+const DefaultLeaseTime = 24 * time.Hour
+const DefaultJournalFile = "nkn-link.journal"
+const DefaultAnnounceInterval = 30 * time.Second
+
+// ClientProfile is the configuration a server pushes to its clients.
+type ClientProfile struct {
+	Routes       []string `yaml:"routes"`
+	DNS          []string `yaml:"dns"`
+	DefaultRoute bool     `yaml:"default_route"`
+}
+
+// PeerConfig is a remote peer and the destinations routed to it.
+type PeerConfig struct {
+	Address     string   `yaml:"address"`
+	AllowedIPs  []string `yaml:"allowed_ips"`
+	Compression string   `yaml:"compression"`
+}
 
 type Config struct {
 	path string
 
-	DefaultRouteEnable         bool   `yaml:"default_route_enable"`
-	DefaultRouteGatewayAddress string `yaml:"default_route_gateway_address"`
-	EnableIPForwarding         bool   `yaml:"enable_ip_forwarding"`
-	NKNAccountSeed             string `yaml:"nkn_account_seed"`
-	NKNRemotePeer              string `yaml:"nkn_remote_peer"`
-	NKNSeedRPCServerAddress    string `yaml:"nkn_seedrpcserver_address"`
-	TunDeviceIPAddress         string `yaml:"tun_device_ip_address"`
-	TunDeviceName              string `yaml:"tun_device_name"`
+	DefaultRouteEnable         bool       `yaml:"default_route_enable"`
+	DefaultRouteGatewayAddress StringList `yaml:"default_route_gateway_address"`
+	DefaultRouteMode           string     `yaml:"default_route_mode"`
+	RouteTable                 int        `yaml:"route_table"`
+	Fwmark                     int        `yaml:"fwmark"`
+	RouteInclude               []string   `yaml:"route_include"`
+	RouteExclude               []string   `yaml:"route_exclude"`
+	TunnelUIDs                 StringList `yaml:"tunnel_uids"`
+	TunnelFwmarks              []int      `yaml:"tunnel_fwmarks"`
+	EnableIPForwarding         bool       `yaml:"enable_ip_forwarding"`
+	LogRejectedSenders         bool       `yaml:"log_rejected_senders"`
+	NKNAccountSeed             string     `yaml:"nkn_account_seed"`
+	NKNRemotePeer              string     `yaml:"nkn_remote_peer"`
+	NKNSeedRPCServerAddress    string     `yaml:"nkn_seedrpcserver_address"`
+	TunDeviceIPAddress         StringList `yaml:"tun_device_ip_address"`
+	TunDeviceName              string     `yaml:"tun_device_name"`
+	TunNoPI                    bool       `yaml:"tun_no_pi"`
+	TransportMode              string     `yaml:"transport_mode"`
+	BatchSize                  int        `yaml:"batch_size"`
+	BatchDelay                 int        `yaml:"batch_delay_ms"`
+	Compression                string     `yaml:"compression"`
+	MTU                        int        `yaml:"mtu"`
+	MaxMessageSize             int        `yaml:"max_message_size"`
+	FragmentTimeout            int        `yaml:"fragment_timeout_ms"`
+	FragmentMemoryLimit        int        `yaml:"fragment_memory_limit"`
+	KeepaliveInterval          int        `yaml:"keepalive_interval_ms"`
+	KeepaliveTimeout           int        `yaml:"keepalive_timeout_ms"`
+
+	Peers []PeerConfig `yaml:"peers"`
+
+	Mode           string     `yaml:"mode"`
+	AddressPool    StringList `yaml:"address_pool"`
+	LeaseFile      string     `yaml:"lease_file"`
+	LeaseTime      int        `yaml:"lease_time_ms"`
+	JournalFile    string     `yaml:"journal_file"`
+	AllowedClients []string   `yaml:"allowed_clients"`
+	ClientToClient bool       `yaml:"client_to_client"`
+
+	ClientProfile ClientProfile `yaml:"client_profile"`
+
+	AdvertisedSubnets []string `yaml:"advertised_subnets"`
+	AcceptSubnets     bool     `yaml:"accept_subnets"`
+	AnnounceInterval  int      `yaml:"announce_interval_ms"`
+	MeshMembers       []string `yaml:"mesh_members"`
 }
 
-func NewConfig(path string) (*Config, error) {
+// NewConfig reads the config file at path. If mode is not empty, it overrides
+// the `mode` of the config file.
+func NewConfig(path string, mode string) (*Config, error) {
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		viper.SetConfigName("config")
@@ -109,14 +199,18 @@ func NewConfig(path string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(mode) > 0 {
+		c.Mode = mode
+	}
 
 	// user preferred seed rpc server address
 	if len(viper.GetString("nkn_seedrpcserver_address")) > 0 {
 		c.NKNSeedRPCServerAddress = viper.GetString("nkn_seedrpcserver_address")
 	}
 
-	// if `nkn_remote_peer` is missing in config file.
-	if len(c.NKNRemotePeer) == 0 {
+	// if neither `nkn_remote_peer` nor `peers` is set in config file. a server waits for its
+	// clients, the first node of a mesh for other nodes.
+	if len(c.NKNRemotePeer) == 0 && len(c.Peers) == 0 && c.GetMode() != ModeServer && c.GetMode() != ModeMesh {
 		reader := bufio.NewReader(os.Stdin)
 		fmt.Print("NKN address of remote peer: ")
 		remote_peer_addr, _ := reader.ReadString('\n')
@@ -125,11 +219,29 @@ func NewConfig(path string) (*Config, error) {
 			return nil, errors.New("No remote peer address provided. Aborting.")
 		}
 		viper.Set("nkn_remote_peer", remote_peer_addr)
+		c.NKNRemotePeer = remote_peer_addr
 	}
 
 	return c, nil
 }
 
+// ReadConfig reads the config file at path without asking for missing
+// settings.
+func ReadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{
+		path: path,
+	}
+	err = yaml.Unmarshal(b, c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
 func (c *Config) Set(key string, value interface{}) {
 	viper.Set(key, value)
 	write()
@@ -151,6 +263,207 @@ func (c *Config) GetNKNRemotePeer() *nkn.StringArray {
 	return nkn.NewStringArray(c.NKNRemotePeer)
 }
 
+// GetTransportMode returns the configured transport mode, defaulting to
+// message mode.
+func (c *Config) GetTransportMode() string {
+	if len(c.TransportMode) == 0 {
+		return TransportModeMessage
+	}
+	return c.TransportMode
+}
+
+// GetBatchDelay returns how long a batch of packets may be held back before
+// it is sent.
+func (c *Config) GetBatchDelay() time.Duration {
+	if c.BatchDelay <= 0 {
+		return DefaultBatchDelay
+	}
+	return time.Duration(c.BatchDelay) * time.Millisecond
+}
+
+// GetMTU returns the MTU of the TUN device.
+func (c *Config) GetMTU() int {
+	if c.MTU <= 0 {
+		return DefaultMTU
+	}
+	return c.MTU
+}
+
+// GetMaxMessageSize returns the size above which messages are split into
+// fragments.
+func (c *Config) GetMaxMessageSize() int {
+	if c.MaxMessageSize <= 0 {
+		return DefaultMaxMessageSize
+	}
+	return c.MaxMessageSize
+}
+
+// GetFragmentTimeout returns how long the fragments of an incomplete message
+// are kept.
+func (c *Config) GetFragmentTimeout() time.Duration {
+	if c.FragmentTimeout <= 0 {
+		return DefaultFragmentTimeout
+	}
+	return time.Duration(c.FragmentTimeout) * time.Millisecond
+}
+
+// GetFragmentMemoryLimit returns the number of bytes all fragments of
+// incomplete messages may occupy.
+func (c *Config) GetFragmentMemoryLimit() int {
+	if c.FragmentMemoryLimit <= 0 {
+		return DefaultFragmentMemoryLimit
+	}
+	return c.FragmentMemoryLimit
+}
+
+// GetKeepaliveInterval returns how often keepalives are sent to every peer.
+func (c *Config) GetKeepaliveInterval() time.Duration {
+	if c.KeepaliveInterval <= 0 {
+		return DefaultKeepaliveInterval
+	}
+	return time.Duration(c.KeepaliveInterval) * time.Millisecond
+}
+
+// GetKeepaliveTimeout returns how long a peer may stay silent before it is
+// considered down.
+func (c *Config) GetKeepaliveTimeout() time.Duration {
+	if c.KeepaliveTimeout <= 0 {
+		return DefaultKeepaliveTimeout
+	}
+	return time.Duration(c.KeepaliveTimeout) * time.Millisecond
+}
+
+// GetMode returns the configured mode, defaulting to peer mode.
+func (c *Config) GetMode() string {
+	if len(c.Mode) == 0 {
+		return ModePeer
+	}
+	return c.Mode
+}
+
+// GetLeaseFile returns the path of the file the leases of a server are
+// persisted to. Relative paths, including the default, are relative to the
+// directory of the config file.
+func (c *Config) GetLeaseFile() string {
+	name := c.LeaseFile
+	if len(name) == 0 {
+		name = DefaultLeaseFile
+	}
+	return nextTo(c.path, name)
+}
+
+// GetLeaseTime returns how long the lease of a client that is not seen
+// anymore is kept.
+func (c *Config) GetLeaseTime() time.Duration {
+	if c.LeaseTime <= 0 {
+		return DefaultLeaseTime
+	}
+	return time.Duration(c.LeaseTime) * time.Millisecond
+}
+
+// GetAnnounceInterval returns how often a mesh node announces its routes.
+func (c *Config) GetAnnounceInterval() time.Duration {
+	if c.AnnounceInterval <= 0 {
+		return DefaultAnnounceInterval
+	}
+	return time.Duration(c.AnnounceInterval) * time.Millisecond
+}
+
+// GetDefaultRouteMode returns how the default route is changed.
+func (c *Config) GetDefaultRouteMode() string {
+	if len(c.DefaultRouteMode) == 0 {
+		return DefaultRouteModeMetric
+	}
+	return strings.ToLower(c.DefaultRouteMode)
+}
+
+// GetRouteTable returns the routing table of the tunnel in the policy
+// default route mode.
+func (c *Config) GetRouteTable() int {
+	if c.RouteTable <= 0 {
+		return DefaultRouteTable
+	}
+	return c.RouteTable
+}
+
+// GetFwmark returns the mark of the NKN sockets in the policy default route
+// mode.
+func (c *Config) GetFwmark() int {
+	if c.Fwmark <= 0 {
+		return DefaultFwmark
+	}
+	return c.Fwmark
+}
+
+// GetJournalFile returns the path of the file the changes to the network
+// configuration of the host are recorded in. Relative paths, including the
+// default, are relative to the directory of the config file.
+func (c *Config) GetJournalFile() string {
+	return JournalFile(c.path, c.JournalFile)
+}
+
+// JournalFile returns the absolute path of the journal file name for the
+// config file at configPath.
+func JournalFile(configPath, name string) string {
+	if len(name) == 0 {
+		name = DefaultJournalFile
+	}
+	return nextTo(configPath, name)
+}
+
+// nextTo returns the absolute path of name, relative to the directory of
+// the config file at configPath.
+func nextTo(configPath, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	dir, err := filepath.Abs(filepath.Dir(configPath))
+	if err != nil {
+		dir = filepath.Dir(configPath)
+	}
+	return filepath.Join(dir, name)
+}
+
+// GetPeers returns the configured peers. If no `peers` are set, the single
+// `nkn_remote_peer` is returned with all destinations routed to it, unless
+// in mesh mode, where the routes are learned. Peers without their own
+// `compression` inherit the global one.
+func (c *Config) GetPeers() []PeerConfig {
+	if len(c.Peers) == 0 {
+		if len(c.NKNRemotePeer) == 0 {
+			return nil
+		}
+		peer := PeerConfig{
+			Address:     c.NKNRemotePeer,
+			AllowedIPs:  []string{"0.0.0.0/0", "::/0"},
+			Compression: c.Compression,
+		}
+		if c.GetMode() == ModeMesh {
+			peer.AllowedIPs = nil
+		}
+		return []PeerConfig{peer}
+	}
+
+	peers := make([]PeerConfig, len(c.Peers))
+	copy(peers, c.Peers)
+	for i := range peers {
+		if len(peers[i].Compression) == 0 {
+			peers[i].Compression = c.Compression
+		}
+	}
+	return peers
+}
+
+// GetSeedRPCServers returns the seed RPC servers the NKN clients may contact:
+// nkn_seedrpcserver_address and the default seeds of the SDK.
+func (c *Config) GetSeedRPCServers() []string {
+	servers := append([]string(nil), nkn.DefaultSeedRPCServerAddr...)
+	if len(c.NKNSeedRPCServerAddress) > 0 {
+		servers = append(servers, c.NKNSeedRPCServerAddress)
+	}
+	return servers
+}
+
 func (c *Config) GetNKNSeedRPCServerAddress() *nkn.StringArray {
 	return nkn.NewStringArray(c.NKNSeedRPCServerAddress)
 }
@@ -0,0 +1,24 @@
+package config
+
+// StringList is a list of strings that can be written as a single string or
+// as a sequence in config.yaml.
+type StringList []string
+
+func (l *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		if len(s) == 0 {
+			*l = nil
+		} else {
+			*l = StringList{s}
+		}
+		return nil
+	}
+
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
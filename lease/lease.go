@@ -0,0 +1,262 @@
+// Package lease assigns addresses from address pools to clients identified
+// by their NKN public key and persists the assignments to disk, so that a
+// client keeps its addresses across restarts. Leases of clients that have not
+// been seen for the lease time expire.
+package lease
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrExhausted is returned by Lease if a pool has no free address left.
+var ErrExhausted = errors.New("address pool exhausted")
+
+// Pool leases one address of every configured prefix to each client.
+type Pool struct {
+	prefixes []*net.IPNet
+	reserved map[string]bool // addresses never leased, e.g. those of the server
+	path     string
+
+	mu     sync.Mutex
+	leases map[string][]string  // addresses by client key, in CIDR notation
+	seen   map[string]time.Time // when the client was last seen, by client key
+	used   map[string]bool      // leased addresses
+}
+
+type leaseFile struct {
+	Leases map[string][]string  `json:"leases"`
+	Seen   map[string]time.Time `json:"seen,omitempty"`
+}
+
+// NewPool returns a pool leasing addresses of the given prefixes, except the
+// reserved ones. Leases are loaded from and saved to the file at path.
+func NewPool(prefixes []*net.IPNet, reserved []net.IP, path string) (*Pool, error) {
+	p := &Pool{
+		prefixes: prefixes,
+		reserved: make(map[string]bool),
+		path:     path,
+		leases:   make(map[string][]string),
+		seen:     make(map[string]time.Time),
+		used:     make(map[string]bool),
+	}
+	for _, ip := range reserved {
+		p.reserved[ip.String()] = true
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var f leaseFile
+		err = json.Unmarshal(b, &f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		now := time.Now()
+		for key, addrs := range f.Leases {
+			p.load(key, addrs)
+			// leases of older files start their lease time now
+			p.seen[key] = now
+			if seen, ok := f.Seen[key]; ok {
+				p.seen[key] = seen
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// load restores the addresses of a persisted lease that still belong to a
+// prefix of the pool.
+func (p *Pool) load(key string, addrs []string) {
+	var kept []string
+	for _, a := range addrs {
+		ip, _, err := net.ParseCIDR(a)
+		if err != nil || p.reserved[ip.String()] || p.used[ip.String()] {
+			continue
+		}
+		prefix := p.prefixOf(ip)
+		if prefix == nil {
+			continue
+		}
+		ones, _ := prefix.Mask.Size()
+		kept = append(kept, fmt.Sprintf("%s/%d", ip, ones))
+		p.used[ip.String()] = true
+	}
+	if len(kept) > 0 {
+		p.leases[key] = kept
+	}
+}
+
+// Lease returns the addresses leased to the client with the given key, with
+// the prefix length of their pool. A client without lease gets the lowest
+// free address of every prefix, and the new lease is saved.
+func (p *Pool) Lease(key string) ([]*net.IPNet, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	addrs := append([]string(nil), p.leases[key]...)
+	var allocated []net.IP
+	for _, prefix := range p.prefixes {
+		if hasAddress(addrs, prefix) {
+			continue
+		}
+		ip, err := p.allocate(prefix)
+		if err != nil {
+			// release the addresses of the other prefixes
+			for _, ip := range allocated {
+				delete(p.used, ip.String())
+			}
+			return nil, fmt.Errorf("%s: %w", prefix, err)
+		}
+		ones, _ := prefix.Mask.Size()
+		addrs = append(addrs, fmt.Sprintf("%s/%d", ip, ones))
+		p.used[ip.String()] = true
+		allocated = append(allocated, ip)
+	}
+
+	p.seen[key] = time.Now()
+	if len(allocated) > 0 {
+		p.leases[key] = addrs
+		err := p.save()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var lease []*net.IPNet
+	for _, a := range addrs {
+		ip, prefix, err := net.ParseCIDR(a)
+		if err != nil {
+			continue
+		}
+		prefix.IP = ip
+		lease = append(lease, prefix)
+	}
+	return lease, nil
+}
+
+// Touch records that the client with the given key has been seen at now,
+// which extends its lease.
+func (p *Pool) Touch(key string, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.leases[key]; ok {
+		p.seen[key] = now
+	}
+}
+
+// Expire releases the leases of clients not seen since before and returns
+// their keys. The remaining leases are saved if any expired.
+func (p *Pool) Expire(before time.Time) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var expired []string
+	for key, addrs := range p.leases {
+		if !p.seen[key].Before(before) {
+			continue
+		}
+		for _, a := range addrs {
+			if ip, _, err := net.ParseCIDR(a); err == nil {
+				delete(p.used, ip.String())
+			}
+		}
+		delete(p.leases, key)
+		delete(p.seen, key)
+		expired = append(expired, key)
+	}
+	if len(expired) == 0 {
+		return nil, nil
+	}
+	return expired, p.save()
+}
+
+// allocate returns the lowest free host address of prefix. Every address of
+// a prefix with at most two addresses, like a /31 or /32, is a host address.
+func (p *Pool) allocate(prefix *net.IPNet) (net.IP, error) {
+	base := prefix.IP.Mask(prefix.Mask)
+	if ip4 := base.To4(); ip4 != nil {
+		base = ip4
+	}
+	ones, bits := prefix.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	last := new(big.Int).Sub(size, big.NewInt(1))
+
+	first := big.NewInt(1)
+	if bits-ones <= 1 {
+		first = big.NewInt(0)
+	}
+	start := new(big.Int).SetBytes(base)
+	for i := first; i.Cmp(size) < 0; i.Add(i, big.NewInt(1)) {
+		// the broadcast address of an IPv4 subnet is no host
+		if len(base) == net.IPv4len && bits-ones > 1 && i.Cmp(last) == 0 {
+			break
+		}
+		ip := toIP(new(big.Int).Add(start, i), len(base))
+		if !p.reserved[ip.String()] && !p.used[ip.String()] {
+			return ip, nil
+		}
+	}
+	return nil, ErrExhausted
+}
+
+// save writes all leases to the lease file, replacing it atomically.
+func (p *Pool) save() error {
+	b, err := json.MarshalIndent(leaseFile{Leases: p.leases, Seen: p.seen}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p.path), filepath.Base(p.path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p.path)
+}
+
+func (p *Pool) prefixOf(ip net.IP) *net.IPNet {
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(ip) {
+			return prefix
+		}
+	}
+	return nil
+}
+
+// hasAddress reports whether one of addrs belongs to prefix.
+func hasAddress(addrs []string, prefix *net.IPNet) bool {
+	for _, a := range addrs {
+		ip, _, err := net.ParseCIDR(a)
+		if err == nil && prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func toIP(n *big.Int, size int) net.IP {
+	b := n.Bytes()
+	ip := make(net.IP, size)
+	copy(ip[size-len(b):], b)
+	return ip
+}
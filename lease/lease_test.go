@@ -0,0 +1,165 @@
+package lease
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func prefixes(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+	var prefixes []*net.IPNet
+	for _, cidr := range cidrs {
+		_, prefix, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+func newTestPool(t *testing.T, path string, reserved []string, cidrs ...string) *Pool {
+	t.Helper()
+	var ips []net.IP
+	for _, r := range reserved {
+		ips = append(ips, net.ParseIP(r))
+	}
+	p, err := NewPool(prefixes(t, cidrs...), ips, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// expectLease leases to key and compares the lease to want.
+func expectLease(t *testing.T, p *Pool, key string, want ...string) {
+	t.Helper()
+	lease, err := p.Lease(key)
+	if err != nil {
+		t.Fatalf("lease of %s: %v", key, err)
+	}
+	if fmt.Sprint(lease) != fmt.Sprint(want) {
+		t.Errorf("lease of %s is %v, want %v", key, lease, want)
+	}
+}
+
+func TestLeaseOrder(t *testing.T) {
+	p := newTestPool(t, filepath.Join(t.TempDir(), "leases.json"), nil, "10.0.0.0/24", "fd00::/64")
+	expectLease(t, p, "a", "10.0.0.1/24", "fd00::1/64")
+	expectLease(t, p, "b", "10.0.0.2/24", "fd00::2/64")
+	expectLease(t, p, "c", "10.0.0.3/24", "fd00::3/64")
+
+	// a client keeps its lease
+	expectLease(t, p, "b", "10.0.0.2/24", "fd00::2/64")
+}
+
+func TestLeaseReserved(t *testing.T) {
+	p := newTestPool(t, filepath.Join(t.TempDir(), "leases.json"), []string{"10.0.0.1", "10.0.0.3"}, "10.0.0.0/24")
+	expectLease(t, p, "a", "10.0.0.2/24")
+	expectLease(t, p, "b", "10.0.0.4/24")
+}
+
+func TestLeaseReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	p := newTestPool(t, path, nil, "10.0.0.0/24")
+	expectLease(t, p, "a", "10.0.0.1/24")
+	expectLease(t, p, "b", "10.0.0.2/24")
+
+	p = newTestPool(t, path, nil, "10.0.0.0/24")
+	expectLease(t, p, "b", "10.0.0.2/24")
+	expectLease(t, p, "c", "10.0.0.3/24")
+	expectLease(t, p, "a", "10.0.0.1/24")
+
+	// leases outside the prefixes of the pool are dropped on load
+	p = newTestPool(t, path, nil, "10.1.0.0/24")
+	expectLease(t, p, "c", "10.1.0.1/24")
+}
+
+func TestLeaseExpire(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	p := newTestPool(t, path, nil, "10.0.0.0/24")
+	expectLease(t, p, "a", "10.0.0.1/24")
+	expectLease(t, p, "b", "10.0.0.2/24")
+
+	later := time.Now().Add(time.Hour)
+	p.Touch("a", later)
+	p.Touch("unknown", later)
+	expired, err := p.Expire(later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(expired) != "[b]" {
+		t.Errorf("expired %v, want [b]", expired)
+	}
+
+	// the address of b is free again, also after a reload
+	p = newTestPool(t, path, nil, "10.0.0.0/24")
+	expectLease(t, p, "c", "10.0.0.2/24")
+
+	// the time a was seen is persisted
+	p.Touch("c", later.Add(time.Hour))
+	expired, err = p.Expire(later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 0 {
+		t.Errorf("expired %v, want none", expired)
+	}
+	expired, err = p.Expire(later.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(expired) != "[a]" {
+		t.Errorf("expired %v, want [a]", expired)
+	}
+}
+
+func TestLeaseExhausted(t *testing.T) {
+	p := newTestPool(t, filepath.Join(t.TempDir(), "leases.json"), nil, "10.0.0.0/30")
+	expectLease(t, p, "a", "10.0.0.1/30")
+	expectLease(t, p, "b", "10.0.0.2/30")
+	_, err := p.Lease("c")
+	if !errors.Is(err, ErrExhausted) {
+		t.Errorf("lease of an exhausted pool returned %v, want %v", err, ErrExhausted)
+	}
+}
+
+func TestLeaseExhaustedReleases(t *testing.T) {
+	p := newTestPool(t, filepath.Join(t.TempDir(), "leases.json"), nil, "10.0.0.0/24", "10.1.0.0/32")
+	expectLease(t, p, "a", "10.0.0.1/24", "10.1.0.0/32")
+	_, err := p.Lease("b")
+	if !errors.Is(err, ErrExhausted) {
+		t.Fatalf("lease of an exhausted pool returned %v, want %v", err, ErrExhausted)
+	}
+
+	// the address of the first prefix is not leaked
+	expired, err := p.Expire(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(expired) != "[a]" {
+		t.Errorf("expired %v, want [a]", expired)
+	}
+	if len(p.used) != 0 {
+		t.Errorf("addresses %v still used", p.used)
+	}
+}
+
+func TestLeaseSmallPrefixes(t *testing.T) {
+	p := newTestPool(t, filepath.Join(t.TempDir(), "leases.json"), nil, "10.0.0.0/31", "fd00::/127")
+	expectLease(t, p, "a", "10.0.0.0/31", "fd00::/127")
+	expectLease(t, p, "b", "10.0.0.1/31", "fd00::1/127")
+	if _, err := p.Lease("c"); !errors.Is(err, ErrExhausted) {
+		t.Errorf("lease of an exhausted /31 returned %v, want %v", err, ErrExhausted)
+	}
+
+	p = newTestPool(t, filepath.Join(t.TempDir(), "leases.json"), nil, "10.0.0.7/32")
+	expectLease(t, p, "a", "10.0.0.7/32")
+	if _, err := p.Lease("b"); !errors.Is(err, ErrExhausted) {
+		t.Errorf("lease of an exhausted /32 returned %v, want %v", err, ErrExhausted)
+	}
+}
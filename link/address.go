@@ -0,0 +1,73 @@
+//go:build linux
+
+package link
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// parseAddress parses an address of the TUN device in the form
+// `local[/prefix] [peer remote[/prefix]]`, like `ip addr add` does. An
+// address without prefix length is a host address.
+func parseAddress(s string) (*netlink.Addr, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 1 && !(len(fields) == 3 && fields[1] == "peer") {
+		return nil, fmt.Errorf("invalid address %q: want `local[/prefix] [peer remote[/prefix]]`", s)
+	}
+
+	local, err := parseHostOrPrefix(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", s, err)
+	}
+	addr := &netlink.Addr{IPNet: local}
+
+	if len(fields) == 3 {
+		remote, err := parseHostOrPrefix(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer address in %q: %w", s, err)
+		}
+		if (local.IP.To4() == nil) != (remote.IP.To4() == nil) {
+			return nil, fmt.Errorf("invalid address %q: local and peer address differ in family", s)
+		}
+		addr.Peer = remote
+	}
+
+	return addr, nil
+}
+
+// parseHostOrPrefix parses an IP address with optional prefix length. The
+// host bits of the address are kept.
+func parseHostOrPrefix(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		ip, prefix, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		prefix.IP = ip
+		if ip4 := ip.To4(); ip4 != nil {
+			prefix.IP = ip4
+		}
+		return prefix, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// formatAddress formats addr like parseAddress accepts it.
+func formatAddress(addr *netlink.Addr) string {
+	if addr.Peer != nil {
+		return addr.IPNet.String() + " peer " + addr.Peer.String()
+	}
+	return addr.IPNet.String()
+}
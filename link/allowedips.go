@@ -0,0 +1,158 @@
+//go:build linux
+
+package link
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// allowedIPs is a longest-prefix-match table mapping IP prefixes to peers,
+// similar to the AllowedIPs of WireGuard. IPv4 and IPv6 prefixes are kept in
+// separate binary tries.
+type allowedIPs struct {
+	mu sync.RWMutex
+	v4 *trieNode
+	v6 *trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	peer     *peer
+}
+
+func newAllowedIPs() *allowedIPs {
+	return &allowedIPs{
+		v4: &trieNode{},
+		v6: &trieNode{},
+	}
+}
+
+// root returns the trie for the family of ip and ip in its canonical length.
+func (t *allowedIPs) root(ip net.IP) (*trieNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return t.v4, ip4
+	}
+	if ip6 := ip.To16(); ip6 != nil {
+		return t.v6, ip6
+	}
+	return nil, nil
+}
+
+// prefixRoot returns the trie for the family of prefix, its address in the
+// canonical length of the trie and its length in bits. IPv4-mapped IPv6
+// prefixes like ::ffff:10.0.0.0/104 are mapped to their IPv4 prefix.
+func (t *allowedIPs) prefixRoot(prefix *net.IPNet) (*trieNode, net.IP, int) {
+	ones, bits := prefix.Mask.Size()
+	switch bits {
+	case 8 * net.IPv4len:
+		if ip4 := prefix.IP.To4(); ip4 != nil {
+			return t.v4, ip4, ones
+		}
+	case 8 * net.IPv6len:
+		ip4 := prefix.IP.To4()
+		if ip4 != nil && ones >= 96 {
+			return t.v4, ip4, ones - 96
+		}
+		if ip6 := prefix.IP.To16(); ip6 != nil {
+			return t.v6, ip6, ones
+		}
+	}
+	return nil, nil, 0
+}
+
+// checkPrefix returns an error if prefix is neither an IPv4 nor an IPv6
+// prefix of a valid length.
+func checkPrefix(prefix *net.IPNet) error {
+	ones, bits := prefix.Mask.Size()
+	switch {
+	case bits == 8*net.IPv4len && len(prefix.IP) == net.IPv4len:
+	case bits == 8*net.IPv6len && len(prefix.IP) == net.IPv6len:
+	default:
+		return fmt.Errorf("invalid prefix %s", prefix)
+	}
+	if ones < 0 || ones > bits {
+		return fmt.Errorf("invalid prefix length of %s", prefix)
+	}
+	return nil
+}
+
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+// Insert maps prefix to p. An existing mapping of the same prefix is
+// replaced.
+func (t *allowedIPs) Insert(prefix *net.IPNet, p *peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if n := t.node(prefix, true); n != nil {
+		n.peer = p
+	}
+}
+
+// Remove removes the mapping of prefix if it maps to p.
+func (t *allowedIPs) Remove(prefix *net.IPNet, p *peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if n := t.node(prefix, false); n != nil && n.peer == p {
+		n.peer = nil
+	}
+}
+
+// Get returns the peer prefix is mapped to, or nil. Unlike Lookup, only the
+// exact prefix is matched.
+func (t *allowedIPs) Get(prefix *net.IPNet) *peer {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if n := t.node(prefix, false); n != nil {
+		return n.peer
+	}
+	return nil
+}
+
+// node returns the node of prefix. Missing nodes are created if create is
+// set, otherwise nil is returned.
+func (t *allowedIPs) node(prefix *net.IPNet, create bool) *trieNode {
+	n, ip, ones := t.prefixRoot(prefix)
+	if n == nil {
+		return nil
+	}
+	for i := 0; i < ones; i++ {
+		b := bit(ip, i)
+		if n.children[b] == nil {
+			if !create {
+				return nil
+			}
+			n.children[b] = &trieNode{}
+		}
+		n = n.children[b]
+	}
+	return n
+}
+
+// Lookup returns the peer of the longest prefix containing ip, or nil.
+func (t *allowedIPs) Lookup(ip net.IP) *peer {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	n, ip := t.root(ip)
+	if n == nil {
+		return nil
+	}
+	match := n.peer
+	for i := 0; i < len(ip)*8; i++ {
+		n = n.children[bit(ip, i)]
+		if n == nil {
+			break
+		}
+		if n.peer != nil {
+			match = n.peer
+		}
+	}
+	return match
+}
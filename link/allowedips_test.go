@@ -0,0 +1,33 @@
+//go:build linux
+
+package link
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAllowedIPsMappedPrefix(t *testing.T) {
+	table := newAllowedIPs()
+	p := &peer{}
+	for _, cidr := range []string{"::ffff:10.0.0.0/104", "::ffff:0:0/96", "fd00::/8"} {
+		_, prefix, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table.Insert(prefix, p)
+		if table.Get(prefix) != p {
+			t.Errorf("Get(%s) did not return the inserted peer", cidr)
+		}
+	}
+
+	if table.Lookup(net.ParseIP("10.1.2.3")) != p {
+		t.Error("IPv4 address not matched by an IPv4-mapped prefix")
+	}
+	if table.Lookup(net.ParseIP("fd00::1")) != p {
+		t.Error("IPv6 address not matched")
+	}
+	if table.Lookup(net.ParseIP("fe80::1")) != nil {
+		t.Error("IPv6 address matched outside of the inserted prefixes")
+	}
+}
@@ -0,0 +1,75 @@
+//go:build linux
+
+package link
+
+import (
+	"sync"
+	"time"
+
+	"github.com/omani/nkn-link/wire"
+)
+
+// batcher coalesces the packets sent to a peer into batch messages. A batch
+// is sent once it reaches its size or when its delay has passed since the
+// first packet was added, whichever comes first.
+type batcher struct {
+	mu    sync.Mutex
+	batch *wire.Batch
+	size  int
+	delay time.Duration
+	timer *time.Timer
+	send  func(msg []byte)
+}
+
+func newBatcher(size int, delay time.Duration, send func(msg []byte)) *batcher {
+	return &batcher{
+		batch: wire.NewBatch(size),
+		size:  size,
+		delay: delay,
+		send:  send,
+	}
+}
+
+// Add adds a copy of packet to the batch, flushing the batch as needed.
+func (b *batcher) Add(packet []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// make room for the packet
+	if b.batch.Count() > 0 && b.batch.Grow(len(packet)) > b.size {
+		b.flush()
+	}
+
+	b.batch.Add(packet)
+	if b.batch.Len() >= b.size {
+		b.flush()
+		return
+	}
+
+	// first packet of a new batch
+	if b.batch.Count() == 1 {
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.delay, b.Flush)
+		} else {
+			b.timer.Reset(b.delay)
+		}
+	}
+}
+
+// Flush sends the pending batch, if any.
+func (b *batcher) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flush()
+}
+
+func (b *batcher) flush() {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	if b.batch.Count() == 0 {
+		return
+	}
+	b.send(b.batch.Bytes())
+	b.batch.Reset()
+}
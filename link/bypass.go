@@ -0,0 +1,216 @@
+//go:build linux
+
+package link
+
+import (
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/omani/nkn-link/transport"
+	"github.com/vishvananda/netlink"
+)
+
+// bypassInterval is how often the nodes of the subclients are polled.
+const bypassInterval = 5 * time.Second
+
+// routeBackend adds and removes routes of the host. Every host of a link
+// implements it.
+type routeBackend interface {
+	addRoute(route netlink.Route) error
+	delRoute(route netlink.Route)
+}
+
+// bypassRoutes keeps host routes over the previous default routes to the NKN
+// nodes the subclients are connected to and to the seed RPC servers, so their
+// connections stay out of the tunnel. Routes of nodes no longer connected are
+// removed. It is safe for concurrent use.
+type bypassRoutes struct {
+	backend routeBackend
+
+	mu        sync.Mutex
+	fallbacks map[int]netlink.Route    // previous default route by family
+	pinned    map[string]net.IP        // seed RPC servers, bypassed as long as the link runs
+	nodes     map[string]net.IP        // nodes of the subclients by address
+	routes    map[string]netlink.Route // installed routes by address
+}
+
+func newBypassRoutes(backend routeBackend) *bypassRoutes {
+	return &bypassRoutes{
+		backend:   backend,
+		fallbacks: make(map[int]netlink.Route),
+		pinned:    make(map[string]net.IP),
+		nodes:     make(map[string]net.IP),
+		routes:    make(map[string]netlink.Route),
+	}
+}
+
+// setFallback sets the previous default route of family and routes the
+// known addresses of the family over it.
+func (b *bypassRoutes) setFallback(family int, route netlink.Route) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fallbacks[family] = route
+	return b.sync()
+}
+
+// pin bypasses ip as long as the link runs.
+func (b *bypassRoutes) pin(ip net.IP) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pinned[ip.String()] = ip
+	return b.sync()
+}
+
+// add bypasses ip until the next call to update.
+func (b *bypassRoutes) add(ip net.IP) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nodes[ip.String()] = ip
+	return b.sync()
+}
+
+// update replaces the bypassed nodes with ips, adding routes to new nodes
+// and removing those to nodes no longer connected.
+func (b *bypassRoutes) update(ips []net.IP) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nodes = make(map[string]net.IP, len(ips))
+	for _, ip := range ips {
+		b.nodes[ip.String()] = ip
+	}
+	return b.sync()
+}
+
+// sync adds and removes routes until there is one for every pinned address
+// and node of a family with a fallback. b.mu must be held.
+func (b *bypassRoutes) sync() error {
+	for addr, route := range b.routes {
+		if b.pinned[addr] == nil && b.nodes[addr] == nil {
+			b.backend.delRoute(route)
+			delete(b.routes, addr)
+		}
+	}
+
+	var err error
+	add := func(addr string, ip net.IP) {
+		if _, ok := b.routes[addr]; ok || err != nil {
+			return
+		}
+		fallback, ok := b.fallbacks[ipFamily(ip)]
+		if !ok {
+			// traffic of a family whose default route was not changed
+			// needs no bypass
+			return
+		}
+		route := netlink.Route{
+			LinkIndex: fallback.LinkIndex,
+			Dst:       hostDst(ip),
+			Src:       fallback.Src,
+			Priority:  fallback.Priority,
+			Table:     fallback.Table,
+			Gw:        fallback.Gw,
+		}
+		err = b.backend.addRoute(route)
+		if err == nil {
+			b.routes[addr] = route
+		}
+	}
+	for addr, ip := range b.pinned {
+		add(addr, ip)
+	}
+	for addr, ip := range b.nodes {
+		add(addr, ip)
+	}
+	return err
+}
+
+// pinSeeds bypasses the seed RPC servers. Their host names are resolved
+// once, before any route is changed.
+func (l *Link) pinSeeds() error {
+	for _, seed := range l.conf.GetSeedRPCServers() {
+		host := seed
+		if u, err := url.Parse(seed); err == nil && len(u.Host) > 0 {
+			host = u.Hostname()
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			log.Printf("Cannot add bypass route to seed RPC server %s: %v\n", seed, err)
+			continue
+		}
+		for _, ip := range ips {
+			err = l.bypassRoutes.pin(ip)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// bypass keeps the connections to the NKN nodes reachable over the previous
+// default routes. The nodes of transports that can list them are polled,
+// those of other transports are taken from their connect events.
+func (l *Link) bypass() {
+	defer l.wg.Done()
+
+	lister, _ := l.transport.(transport.NodeLister)
+	ticker := time.NewTicker(bypassInterval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case <-l.stop:
+			return
+		case node, ok := <-l.transport.OnConnect():
+			if !ok {
+				return
+			}
+			if lister != nil {
+				err = l.bypassRoutes.update(nodeIPs(lister.Nodes()))
+				break
+			}
+			for _, ip := range nodeIPs([]*transport.Node{node}) {
+				err = l.bypassRoutes.add(ip)
+				if err != nil {
+					break
+				}
+			}
+		case <-ticker.C:
+			if lister == nil {
+				continue
+			}
+			err = l.bypassRoutes.update(nodeIPs(lister.Nodes()))
+		}
+		if err != nil {
+			l.fail(err)
+			return
+		}
+	}
+}
+
+// nodeIPs returns the IP addresses of the nodes and of their RPC servers.
+func nodeIPs(nodes []*transport.Node) []net.IP {
+	var ips []net.IP
+	for _, node := range nodes {
+		for _, addr := range []string{node.Addr, node.RPCAddr} {
+			if len(addr) == 0 {
+				continue
+			}
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				host = addr
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				log.Printf("Cannot add bypass route to NKN node %s: not an IP address.\n", addr)
+				continue
+			}
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
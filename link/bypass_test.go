@@ -0,0 +1,215 @@
+//go:build linux
+
+package link
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// recordingBackend is a routeBackend keeping the routes in memory.
+type recordingBackend struct {
+	mu     sync.Mutex
+	routes map[string]netlink.Route // routes by destination
+	adds   int
+	dels   int
+}
+
+func newRecordingBackend() *recordingBackend {
+	return &recordingBackend{routes: make(map[string]netlink.Route)}
+}
+
+func (r *recordingBackend) addRoute(route netlink.Route) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dst := route.Dst.String()
+	if _, ok := r.routes[dst]; ok {
+		return fmt.Errorf("route to %s exists", dst)
+	}
+	r.routes[dst] = route
+	r.adds++
+	return nil
+}
+
+func (r *recordingBackend) delRoute(route netlink.Route) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.routes, route.Dst.String())
+	r.dels++
+}
+
+// dsts returns the sorted destinations of the installed routes.
+func (r *recordingBackend) dsts() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var dsts []string
+	for dst := range r.routes {
+		dsts = append(dsts, dst)
+	}
+	sort.Strings(dsts)
+	return dsts
+}
+
+func (r *recordingBackend) expect(t *testing.T, want ...string) {
+	t.Helper()
+	got := r.dsts()
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("routes %v, want %v", got, want)
+	}
+}
+
+var (
+	fallbackV4 = netlink.Route{LinkIndex: 2, Gw: net.ParseIP("192.168.1.1"), Priority: fallbackPriority}
+	fallbackV6 = netlink.Route{LinkIndex: 3, Gw: net.ParseIP("fe80::1"), Priority: fallbackPriority}
+)
+
+func ips(addrs ...string) []net.IP {
+	var ips []net.IP
+	for _, addr := range addrs {
+		ips = append(ips, net.ParseIP(addr))
+	}
+	return ips
+}
+
+func TestBypassRoutesUpdate(t *testing.T) {
+	backend := newRecordingBackend()
+	b := newBypassRoutes(backend)
+	if err := b.setFallback(netlink.FAMILY_V4, fallbackV4); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.update(ips("1.1.1.1", "2.2.2.2")); err != nil {
+		t.Fatal(err)
+	}
+	backend.expect(t, "1.1.1.1/32", "2.2.2.2/32")
+
+	// a node replaced by another one
+	if err := b.update(ips("2.2.2.2", "3.3.3.3")); err != nil {
+		t.Fatal(err)
+	}
+	backend.expect(t, "2.2.2.2/32", "3.3.3.3/32")
+
+	// a node added on connect is removed by the next update
+	if err := b.add(net.ParseIP("4.4.4.4")); err != nil {
+		t.Fatal(err)
+	}
+	backend.expect(t, "2.2.2.2/32", "3.3.3.3/32", "4.4.4.4/32")
+	if err := b.update(ips("3.3.3.3")); err != nil {
+		t.Fatal(err)
+	}
+	backend.expect(t, "3.3.3.3/32")
+
+	if backend.adds != 4 || backend.dels != 3 {
+		t.Errorf("%d routes added and %d removed, want 4 and 3", backend.adds, backend.dels)
+	}
+
+	route := backend.routes["3.3.3.3/32"]
+	if route.LinkIndex != fallbackV4.LinkIndex || !route.Gw.Equal(fallbackV4.Gw) || route.Priority != fallbackV4.Priority {
+		t.Errorf("route %v does not go over the fallback %v", route, fallbackV4)
+	}
+}
+
+func TestBypassRoutesPinned(t *testing.T) {
+	backend := newRecordingBackend()
+	b := newBypassRoutes(backend)
+	if err := b.setFallback(netlink.FAMILY_V4, fallbackV4); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.pin(net.ParseIP("9.9.9.9")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.update(ips("1.1.1.1", "9.9.9.9")); err != nil {
+		t.Fatal(err)
+	}
+	backend.expect(t, "1.1.1.1/32", "9.9.9.9/32")
+
+	// a seed survives updates without it, also if it was a node
+	if err := b.update(nil); err != nil {
+		t.Fatal(err)
+	}
+	backend.expect(t, "9.9.9.9/32")
+	if backend.adds != 2 {
+		t.Errorf("%d routes added, want 2", backend.adds)
+	}
+}
+
+func TestBypassRoutesFallbackPerFamily(t *testing.T) {
+	backend := newRecordingBackend()
+	b := newBypassRoutes(backend)
+
+	// without a fallback, the default route was not changed
+	if err := b.pin(net.ParseIP("9.9.9.9")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.update(ips("1.1.1.1", "2001:db8::1")); err != nil {
+		t.Fatal(err)
+	}
+	backend.expect(t)
+
+	// known addresses are routed once their family gets a fallback
+	if err := b.setFallback(netlink.FAMILY_V4, fallbackV4); err != nil {
+		t.Fatal(err)
+	}
+	backend.expect(t, "1.1.1.1/32", "9.9.9.9/32")
+
+	if err := b.setFallback(netlink.FAMILY_V6, fallbackV6); err != nil {
+		t.Fatal(err)
+	}
+	backend.expect(t, "1.1.1.1/32", "9.9.9.9/32", "2001:db8::1/128")
+	route := backend.routes["2001:db8::1/128"]
+	if route.LinkIndex != fallbackV6.LinkIndex || !route.Gw.Equal(fallbackV6.Gw) {
+		t.Errorf("route %v does not go over the IPv6 fallback %v", route, fallbackV6)
+	}
+}
+
+// TestBypassRoutesConcurrent is meant to be run with -race.
+func TestBypassRoutesConcurrent(t *testing.T) {
+	backend := newRecordingBackend()
+	b := newBypassRoutes(backend)
+	if err := b.setFallback(netlink.FAMILY_V4, fallbackV4); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := b.update(ips(fmt.Sprintf("10.0.%d.%d", i, j), "10.1.0.1")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := b.add(net.ParseIP(fmt.Sprintf("10.2.%d.%d", i, j))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// the last update leaves its nodes
+	if err := b.update(ips("10.1.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	backend.expect(t, "10.1.0.1/32")
+	b.mu.Lock()
+	n := len(b.routes)
+	b.mu.Unlock()
+	if n != 1 {
+		t.Errorf("%d routes tracked, want 1", n)
+	}
+}
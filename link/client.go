@@ -0,0 +1,149 @@
+//go:build linux
+
+package link
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/omani/nkn-link/wire"
+	"github.com/vishvananda/netlink"
+)
+
+// applyLease configures the TUN device of a client with the addresses leased
+// by the server. Addresses of a previous, different lease are removed.
+func (l *Link) applyLease(lease []string) error {
+	var addrs []*netlink.Addr
+	for _, a := range lease {
+		prefix, err := parseHostOrPrefix(a)
+		if err != nil {
+			return fmt.Errorf("invalid lease %q: %w", a, err)
+		}
+		addrs = append(addrs, &netlink.Addr{IPNet: prefix})
+	}
+
+	current := l.addresses()
+	if sameAddresses(current, addrs) {
+		return nil
+	}
+
+	for _, addr := range current {
+		l.host.delAddr(addr)
+	}
+	for _, addr := range addrs {
+		err := l.host.addAddr(addr)
+		if err != nil {
+			return fmt.Errorf("could not add leased address %s: %w", addr.IPNet, err)
+		}
+	}
+
+	l.mu.Lock()
+	first := len(l.addrs) == 0
+	l.addrs = addrs
+	l.mu.Unlock()
+	log.Printf("Leased %s from the server.\n", strings.Join(lease, ", "))
+
+	// the default route needs an address of the tunnel
+	if first {
+		return l.setupDefaultRoutes()
+	}
+	return nil
+}
+
+// sameAddresses reports whether a and b hold the same addresses.
+func sameAddresses(a, b []*netlink.Addr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].IPNet.String() != b[i].IPNet.String() {
+			return false
+		}
+	}
+	return true
+}
+
+// applyProfile applies the profile pushed by the server once: the mtu, the
+// routes through the tunnel, the DNS servers and the default route through
+// the tunnel addresses of the server given by gateways. Everything is undone
+// when the link is closed. If a step fails, the next handshake applies the
+// steps not applied yet.
+func (l *Link) applyProfile(profile *wire.Profile, gateways []string) error {
+	l.mu.Lock()
+	applied := l.profileSet
+	l.mu.Unlock()
+	if applied {
+		return nil
+	}
+	if l.profileSteps == nil {
+		l.profileSteps = make(map[string]bool)
+	}
+
+	if profile.MTU > 0 && profile.MTU != l.getMTU() {
+		if profile.MTU < minMTU || profile.MTU > maxMTU {
+			return fmt.Errorf("mtu %d of server out of range [%d, %d]", profile.MTU, minMTU, maxMTU)
+		}
+		err := l.host.setMTU(profile.MTU)
+		if err != nil {
+			return err
+		}
+		l.setMTU(profile.MTU)
+	}
+
+	for _, cidr := range profile.Routes {
+		_, dst, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid route %q: %w", cidr, err)
+		}
+		step := "route " + dst.String()
+		if l.profileSteps[step] {
+			continue
+		}
+		err = l.host.addRoute(netlink.Route{
+			LinkIndex: l.tunLink.Attrs().Index,
+			Dst:       dst,
+			Scope:     netlink.SCOPE_LINK,
+		})
+		if err != nil {
+			return fmt.Errorf("could not add route %s: %w", dst, err)
+		}
+		l.profileSteps[step] = true
+	}
+
+	if len(profile.DNS) > 0 && !l.profileSteps["dns"] {
+		err := l.host.setDNS(profile.DNS)
+		if err != nil {
+			return err
+		}
+		l.profileSteps["dns"] = true
+	}
+
+	// a default route configured locally has been set up with the lease
+	if profile.DefaultRoute && !l.conf.DefaultRouteEnable {
+		for _, gateway := range gateways {
+			gw := net.ParseIP(gateway)
+			if gw == nil || l.tunAddress(ipFamily(gw)) == nil {
+				continue
+			}
+			step := "gateway " + gw.String()
+			if l.profileSteps[step] {
+				continue
+			}
+			err := l.setupDefaultRoute(gateway)
+			if err != nil {
+				return err
+			}
+			l.profileSteps[step] = true
+		}
+	}
+
+	l.mu.Lock()
+	l.profileSet = true
+	l.mu.Unlock()
+
+	log.Printf("Applied profile of the server: mtu %d, routes [%s], dns [%s], default route %t.\n",
+		l.getMTU(), strings.Join(profile.Routes, ", "), strings.Join(profile.DNS, ", "), profile.DefaultRoute)
+	return nil
+}
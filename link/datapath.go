@@ -0,0 +1,270 @@
+//go:build linux
+
+package link
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"github.com/omani/nkn-link/transport"
+	"github.com/omani/nkn-link/tun"
+	"github.com/omani/nkn-link/wire"
+)
+
+// tx reads packets from the TUN device and sends each to the peer its
+// destination is routed to.
+func (l *Link) tx() {
+	defer l.wg.Done()
+
+	// leave room in front of the packet for the headers of the device and
+	// the header of the message. the mtu may be raised by the server.
+	offset := wire.HeaderLen + tun.Offset
+	buf := make([]byte, offset+maxMTU)
+	for {
+		n, err := l.device.Read(buf, offset)
+		if err != nil {
+			if !l.stopping() {
+				l.fail(err)
+			}
+			return
+		}
+		packet := buf[offset : offset+n]
+		if l.Debug {
+			dump("SENDING", packet)
+		}
+
+		// pick the peer by the destination of the packet
+		dst := destination(packet)
+		if dst == nil {
+			continue
+		}
+		p := l.table.Lookup(dst)
+		if p == nil {
+			atomic.AddUint64(&l.counters.txNoPeer, 1)
+			if l.Debug {
+				log.Printf("No peer for destination %s. Dropping packet.\n", dst)
+			}
+			continue
+		}
+		if !p.isReady() {
+			atomic.AddUint64(&l.counters.txNotReady, 1)
+			continue
+		}
+
+		if p.batcher != nil && len(packet) <= wire.MaxBatchedPacket {
+			p.batcher.Add(packet)
+		} else {
+			msg := buf[offset-wire.HeaderLen : offset+n]
+			wire.PutHeader(msg, wire.TypePacket)
+			l.send(p, msg)
+		}
+		atomic.AddUint64(&l.counters.txPackets, 1)
+		atomic.AddUint64(&p.counters.txPackets, 1)
+	}
+}
+
+// send compresses a message with the codec of peer p and sends it, split into
+// fragments if it is too large. A failed send stops the link.
+func (l *Link) send(p *peer, msg []byte) {
+	if p.codec != wire.CodecNone {
+		n := len(msg)
+		msg = wire.Compress(msg, p.codec)
+		if len(msg) < n {
+			atomic.AddUint64(&l.counters.txCompressed, 1)
+		}
+	}
+
+	if len(msg) <= l.maxMessageSize {
+		l.sendMessage(p, msg)
+		return
+	}
+
+	// split messages exceeding the maximum message size
+	fragments, err := wire.Fragment(msg, atomic.AddUint32(&l.fragmentID, 1), l.maxMessageSize)
+	if err != nil {
+		if l.Debug {
+			log.Printf("Could not fragment message to peer %s: %v\n", p.address, err)
+		}
+		return
+	}
+	for _, fragment := range fragments {
+		if !l.sendMessage(p, fragment) {
+			return
+		}
+		atomic.AddUint64(&l.counters.txFragments, 1)
+	}
+}
+
+// sendMessage sends msg to peer p as is and reports whether it succeeded.
+func (l *Link) sendMessage(p *peer, msg []byte) bool {
+	err := l.transport.Send(p.address, msg)
+	if err != nil {
+		if !l.stopping() {
+			l.fail(err)
+		}
+		return false
+	}
+	atomic.AddUint64(&l.counters.txMessages, 1)
+	return true
+}
+
+// rx writes packets received from the peers to the TUN device. Messages from
+// any other sender are dropped.
+func (l *Link) rx() {
+	defer l.wg.Done()
+
+	for {
+		msg, ok := <-l.transport.Receive()
+		if !ok {
+			if !l.stopping() {
+				l.fail(transport.ErrClosed)
+			}
+			return
+		}
+
+		// only accept packets from configured peers and new clients of a server
+		p := l.peerByAddress(msg.Src)
+		if p == nil {
+			p = l.accept(msg.Src, msg.Data)
+		}
+		if p == nil {
+			atomic.AddUint64(&l.counters.rxUnknownSender, 1)
+			if l.conf.LogRejectedSenders {
+				log.Printf("Rejected message from unknown sender %s.\n", msg.Src)
+			}
+			continue
+		}
+		atomic.AddUint64(&l.counters.rxMessages, 1)
+		l.seen(p)
+
+		data := msg.Data
+		typ, err := wire.Type(data)
+		if err != nil {
+			l.invalid(p, err)
+			continue
+		}
+		switch typ {
+		case wire.TypeKeepalive:
+			l.handleKeepalive(p, data)
+			continue
+		case wire.TypeHandshake:
+			l.handleHandshake(p, data)
+			continue
+		case wire.TypeAnnounce:
+			if l.mesh != nil {
+				l.handleAnnounce(p, data)
+			}
+			continue
+		}
+
+		// data is only accepted after the handshake
+		if !p.isReady() {
+			atomic.AddUint64(&l.counters.rxNotReady, 1)
+			continue
+		}
+		switch typ {
+		case wire.TypeFragment:
+			atomic.AddUint64(&l.counters.rxFragments, 1)
+			h, fragment, err := wire.ParseFragment(data)
+			if err != nil {
+				l.invalid(p, err)
+				continue
+			}
+			data = l.reassembler.Add(p, h, fragment)
+			if data == nil {
+				continue
+			}
+		}
+
+		// errors writing to the TUN device stop the link, malformed messages
+		// are only counted
+		var werr error
+		err = wire.Decode(data, func(packet []byte) error {
+			werr = l.receive(p, packet)
+			return werr
+		})
+		if werr != nil {
+			if !l.stopping() {
+				l.fail(werr)
+			}
+			return
+		}
+		if err != nil {
+			l.invalid(p, err)
+		}
+	}
+}
+
+// invalid counts a malformed message received from peer p. Messages of an
+// unknown wire format version are logged once per peer.
+func (l *Link) invalid(p *peer, err error) {
+	if errors.Is(err, wire.ErrUnknownVersion) {
+		atomic.AddUint64(&l.counters.rxUnknownVersion, 1)
+		if atomic.CompareAndSwapUint32(&p.versionWarned, 0, 1) {
+			log.Printf("Rejecting messages from peer %s: %v (is the peer running a compatible version of nkn-link?)\n", p.address, err)
+		}
+		return
+	}
+	atomic.AddUint64(&l.counters.rxInvalid, 1)
+	if l.Debug {
+		log.Printf("Invalid message from peer %s: %v\n", p.address, err)
+	}
+}
+
+// receive writes a packet received from peer p to the TUN device.
+func (l *Link) receive(p *peer, packet []byte) error {
+	// the source of the packet must be routed back to the same peer
+	src := source(packet)
+	if src == nil {
+		atomic.AddUint64(&l.counters.rxInvalid, 1)
+		return nil
+	}
+	if l.table.Lookup(src) != p {
+		atomic.AddUint64(&l.counters.rxSpoofed, 1)
+		atomic.AddUint64(&p.counters.rxSpoofed, 1)
+		if l.Debug {
+			log.Printf("Source %s not allowed for peer %s. Dropping packet.\n", src, p.address)
+		}
+		return nil
+	}
+
+	if l.Debug {
+		dump("RECEIVED", packet)
+	}
+
+	// a server relays packets between its clients
+	if l.relay(p, packet) {
+		atomic.AddUint64(&p.counters.rxPackets, 1)
+		return nil
+	}
+
+	// the device needs room in front of the packet for its headers
+	if len(l.rxbuf) < tun.Offset+len(packet) {
+		l.rxbuf = make([]byte, tun.Offset+len(packet))
+	}
+	n := copy(l.rxbuf[tun.Offset:], packet)
+	_, err := l.device.Write(l.rxbuf[:tun.Offset+n], tun.Offset)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&l.counters.rxPackets, 1)
+	atomic.AddUint64(&p.counters.rxPackets, 1)
+	return nil
+}
+
+// dump prints the IP header of a packet.
+func dump(title string, packet []byte) {
+	fmt.Printf("----------------%s----------------\n", title)
+	log.Printf("Dst: %s\n", destination(packet))
+	log.Printf("Src: %s\n", source(packet))
+	if len(packet) > 0 {
+		log.Printf("Version: %d\n", packet[0]>>4)
+	}
+	log.Printf("Protocol: %d\n", protocol(packet))
+	log.Printf("Length: %d\n", len(packet))
+	log.Printf("Payload: % x\n", packet)
+	fmt.Printf("----------------%s----------------\n\n", strings.Repeat("-", len(title)))
+}
@@ -0,0 +1,266 @@
+//go:build linux
+
+package link
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omani/nkn-link/config"
+	"github.com/omani/nkn-link/transport"
+	"github.com/omani/nkn-link/tun"
+)
+
+// chanDevice is a tun.Device exchanging packets over channels instead of the
+// kernel.
+type chanDevice struct {
+	in     chan []byte // packets read by the link
+	out    chan []byte // packets written by the link
+	events chan tun.Event
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newChanDevice() *chanDevice {
+	return &chanDevice{
+		in:     make(chan []byte),
+		out:    make(chan []byte, 1024),
+		events: make(chan tun.Event),
+		closed: make(chan struct{}),
+	}
+}
+
+func (d *chanDevice) File() *os.File { return nil }
+
+func (d *chanDevice) Read(buf []byte, offset int) (int, error) {
+	select {
+	case packet := <-d.in:
+		return copy(buf[offset:], packet), nil
+	case <-d.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (d *chanDevice) Write(buf []byte, offset int) (int, error) {
+	packet := make([]byte, len(buf)-offset)
+	copy(packet, buf[offset:])
+	select {
+	case d.out <- packet:
+	default: // full, dropped like by a busy kernel
+	}
+	return len(buf), nil
+}
+
+func (d *chanDevice) Flush() error           { return nil }
+func (d *chanDevice) MTU() (int, error)      { return config.DefaultMTU, nil }
+func (d *chanDevice) Name() (string, error)  { return "chan0", nil }
+func (d *chanDevice) Events() chan tun.Event { return d.events }
+func (d *chanDevice) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return nil
+}
+
+// udpPacket returns an IPv4 packet from src to dst with an empty UDP
+// datagram.
+func udpPacket(src, dst string) []byte {
+	packet := []byte{
+		0x45, 0x00, 0x00, 0x1c, 0x00, 0x00, 0x00, 0x00, 0x40, 0x11, 0x00, 0x00,
+		0, 0, 0, 0, 0, 0, 0, 0,
+		0x30, 0x39, 0x30, 0x39, 0x00, 0x08, 0x00, 0x00,
+	}
+	copy(packet[12:16], net.ParseIP(src).To4())
+	copy(packet[16:20], net.ParseIP(dst).To4())
+	return packet
+}
+
+// startLoopback starts a link with the given configuration on network. The
+// link is closed when the test ends.
+func startLoopback(tb testing.TB, network *transport.LoopbackNetwork, addr string, conf *config.Config) (*Link, *chanDevice) {
+	tb.Helper()
+	device := newChanDevice()
+	l := NewWithDevice(conf, network.Join(addr), device)
+	err := l.Start(context.Background())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	return l, device
+}
+
+// startLoopbackPair starts two links connected over a loopback network and
+// returns their devices.
+func startLoopbackPair(tb testing.TB) (a, b *chanDevice) {
+	tb.Helper()
+	network := transport.NewLoopbackNetwork()
+	peer := func(ip, remote, remoteIP string) *config.Config {
+		return &config.Config{
+			TunDeviceIPAddress: config.StringList{ip + "/24"},
+			Peers: []config.PeerConfig{{
+				Address:    remote,
+				AllowedIPs: []string{remoteIP + "/32"},
+			}},
+		}
+	}
+	_, a = startLoopback(tb, network, "a", peer("10.0.0.1", "b", "10.0.0.2"))
+	_, b = startLoopback(tb, network, "b", peer("10.0.0.2", "a", "10.0.0.1"))
+	return a, b
+}
+
+// waitPacket sends packet from a until it arrives at b. Packets are dropped
+// until the peers have completed the handshake.
+func waitPacket(tb testing.TB, a, b *chanDevice, packet []byte) {
+	tb.Helper()
+	deadline := time.After(10 * time.Second)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case a.in <- packet:
+		case received := <-b.out:
+			if !bytes.Equal(received, packet) {
+				tb.Fatalf("received %x, want %x", received, packet)
+			}
+			// drain packets still in flight
+			time.Sleep(50 * time.Millisecond)
+			for len(b.out) > 0 {
+				<-b.out
+			}
+			return
+		case <-deadline:
+			tb.Fatal("no packet received before the deadline")
+		}
+		<-ticker.C
+	}
+}
+
+// waitFor polls cond until it holds.
+func waitFor(tb testing.TB, what string, cond func() bool) {
+	tb.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatalf("%s before the deadline", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// routeDsts returns the destinations of the routes added to h.
+func (h *deviceHost) routeDsts() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var dsts []string
+	for _, route := range h.added {
+		dsts = append(dsts, route.Dst.String())
+	}
+	return dsts
+}
+
+func TestLoopbackDataPath(t *testing.T) {
+	a, b := startLoopbackPair(t)
+	packet := udpPacket("10.0.0.1", "10.0.0.2")
+	waitPacket(t, a, b, packet)
+
+	for i := 0; i < 100; i++ {
+		a.in <- packet
+		select {
+		case received := <-b.out:
+			if !bytes.Equal(received, packet) {
+				t.Fatalf("received %x, want %x", received, packet)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("packet %d not received", i)
+		}
+	}
+}
+
+func BenchmarkLoopbackDataPath(b *testing.B) {
+	src, dst := startLoopbackPair(b)
+	packet := udpPacket("10.0.0.1", "10.0.0.2")
+	waitPacket(b, src, dst, packet)
+
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src.in <- packet
+		<-dst.out
+	}
+}
+
+func TestLoopbackAdvertisedSubnets(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	la, a := startLoopback(t, network, "a", &config.Config{
+		TunDeviceIPAddress: config.StringList{"10.0.0.1/24"},
+		Peers: []config.PeerConfig{{
+			Address:    "b",
+			AllowedIPs: []string{"10.0.0.2/32", "192.168.50.0/24"},
+		}},
+	})
+	_, b := startLoopback(t, network, "b", &config.Config{
+		TunDeviceIPAddress: config.StringList{"10.0.0.2/24"},
+		AdvertisedSubnets:  []string{"192.168.50.0/24"},
+		Peers: []config.PeerConfig{{
+			Address:    "a",
+			AllowedIPs: []string{"10.0.0.1/32"},
+		}},
+	})
+
+	// the host of a routes the subnet of b through the tunnel
+	waitPacket(t, a, b, udpPacket("10.0.0.1", "192.168.50.1"))
+	h := la.host.(*deviceHost)
+	waitFor(t, "no route to the subnet", func() bool {
+		for _, dst := range h.routeDsts() {
+			if dst == "192.168.50.0/24" {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestLoopbackLeaseAndProfile(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	_, server := startLoopback(t, network, "server", &config.Config{
+		Mode:        config.ModeServer,
+		AddressPool: config.StringList{"10.8.0.0/24"},
+		LeaseFile:   filepath.Join(t.TempDir(), "leases.json"),
+		ClientProfile: config.ClientProfile{
+			Routes: []string{"10.9.0.0/16"},
+			DNS:    []string{"10.8.0.1"},
+		},
+	})
+	lc, client := startLoopback(t, network, "client", &config.Config{
+		Mode: config.ModeClient,
+		MTU:  1280,
+		Peers: []config.PeerConfig{{
+			Address:    "server",
+			AllowedIPs: []string{"10.8.0.0/24", "10.9.0.0/16"},
+		}},
+	})
+
+	waitPacket(t, client, server, udpPacket("10.8.0.2", "10.8.0.1"))
+
+	// the client took the lease and the profile of the server
+	h := lc.host.(*deviceHost)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.addrs) != 1 || h.addrs[0] != "10.8.0.2/24" {
+		t.Errorf("addresses %v, want [10.8.0.2/24]", h.addrs)
+	}
+	if h.mtu != config.DefaultMTU {
+		t.Errorf("mtu %d, want the mtu %d of the server", h.mtu, config.DefaultMTU)
+	}
+	if len(h.added) != 1 || h.added[0].Dst.String() != "10.9.0.0/16" {
+		t.Errorf("routes %v, want the route to 10.9.0.0/16", h.added)
+	}
+	if len(h.dns) != 1 || h.dns[0] != "10.8.0.1" {
+		t.Errorf("dns %v, want [10.8.0.1]", h.dns)
+	}
+}
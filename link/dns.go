@@ -0,0 +1,36 @@
+//go:build linux
+
+package link
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// setDNS registers the DNS servers of the TUN device iface with resolvconf,
+// like wg-quick does.
+func setDNS(iface string, servers []string) error {
+	var conf bytes.Buffer
+	for _, server := range servers {
+		fmt.Fprintf(&conf, "nameserver %s\n", server)
+	}
+
+	cmd := exec.Command("resolvconf", "-a", iface, "-m", "0", "-x")
+	cmd.Stdin = &conf
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("resolvconf: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// unsetDNS removes the DNS servers of the TUN device iface from resolvconf.
+func unsetDNS(iface string) error {
+	out, err := exec.Command("resolvconf", "-d", iface, "-f").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("resolvconf: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+//go:build linux
+
+package link
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/omani/nkn-link/config"
+	"github.com/omani/nkn-link/wire"
+)
+
+// handshake returns the handshake of the local peer.
+func (l *Link) handshake() *wire.Handshake {
+	h := &wire.Handshake{
+		Version:  int(wire.Version),
+		MTU:      l.getMTU(),
+		Features: wire.Features(),
+		Subnets:  l.conf.AdvertisedSubnets,
+	}
+	for _, addr := range l.addresses() {
+		h.Addresses = append(h.Addresses, addr.IP.String())
+	}
+	return h
+}
+
+// greet sends the local handshake to peer p. If reply is set, it answers a
+// handshake of the peer.
+func (l *Link) greet(p *peer, reply bool) {
+	h := l.handshakeFor(p)
+	h.Reply = reply
+	l.sendHandshake(p, h)
+}
+
+// handshakeFor returns the handshake sent to peer p. Clients of a server get
+// their lease and profile with it.
+func (l *Link) handshakeFor(p *peer) *wire.Handshake {
+	h := l.handshake()
+	for _, addr := range p.lease {
+		h.Lease = append(h.Lease, addr.String())
+	}
+	if p.lease != nil {
+		h.Profile = l.profile
+	}
+	return h
+}
+
+func (l *Link) sendHandshake(p *peer, h *wire.Handshake) {
+	msg, err := wire.EncodeHandshake(h)
+	if err != nil {
+		log.Printf("Could not encode handshake for peer %s: %v\n", p.address, err)
+		return
+	}
+	l.sendMessage(p, msg)
+}
+
+// handleHandshake checks a handshake received from peer p. Traffic to and
+// from the peer is enabled once its handshake is compatible to the local
+// configuration, otherwise the handshake is rejected.
+func (l *Link) handleHandshake(p *peer, msg []byte) {
+	h, err := wire.ParseHandshake(msg)
+	if err != nil {
+		l.invalid(p, err)
+		return
+	}
+
+	// a mesh node waits for the routes of the peer before it can check them
+	if l.mesh != nil && len(p.allowedIPs) == 0 && !l.hasLearned(p) {
+		return
+	}
+
+	// a client configures the addresses leased by the server first, even
+	// from a rejection, so the next handshake can succeed
+	if l.mode == config.ModeClient && len(h.Error) > 0 && len(h.Lease) > 0 {
+		err = l.applyLease(h.Lease)
+		if err == nil && h.Profile != nil {
+			err = l.applyProfile(h.Profile, h.Addresses)
+		}
+		if err != nil {
+			log.Printf("Could not apply lease of peer %s: %v\n", p.address, err)
+		}
+	}
+	if len(h.Error) > 0 {
+		p.setReady(false)
+		l.mismatch(p, fmt.Errorf("peer rejected handshake: %s", h.Error))
+		return
+	}
+
+	if l.mode == config.ModeClient {
+		if len(h.Lease) == 0 {
+			err = errors.New("peer did not lease any address (is it running in server mode?)")
+		} else {
+			err = l.applyLease(h.Lease)
+		}
+		if err == nil && h.Profile != nil {
+			err = l.applyProfile(h.Profile, h.Addresses)
+		}
+	}
+	if err == nil {
+		err = l.checkHandshake(p, h)
+	}
+	if err != nil {
+		p.setReady(false)
+		l.mismatch(p, err)
+		// a client needs its lease and profile to fix what the server
+		// rejects
+		reject := l.handshakeFor(p)
+		reject.Reply = true
+		reject.Error = err.Error()
+		l.sendHandshake(p, reject)
+		return
+	}
+
+	if !h.Reply {
+		l.greet(p, true)
+	}
+	if p.setReady(true) {
+		log.Printf("Handshake with peer %s completed (mtu %d, features %s).\n", p.address, h.MTU, strings.Join(h.Features, ","))
+	}
+	l.installSubnets(p, h.Subnets)
+}
+
+// checkHandshake returns an error if the configuration of peer p announced
+// by its handshake does not match the local configuration.
+func (l *Link) checkHandshake(p *peer, h *wire.Handshake) error {
+	if h.Version != int(wire.Version) {
+		return fmt.Errorf("wire format version %d differs from local version %d", h.Version, wire.Version)
+	}
+	// a client adopts the mtu of the profile of the server only after the
+	// first handshake
+	profileMTU := p.lease != nil && l.profile != nil && l.profile.MTU > 0
+	if mtu := l.getMTU(); h.MTU != mtu && !profileMTU {
+		return fmt.Errorf("mtu %d differs from local mtu %d (set the same `mtu` on both peers)", h.MTU, mtu)
+	}
+
+	// the peer must be able to receive what we send
+	if p.batcher != nil && !h.Has(wire.FeatureBatch) {
+		return fmt.Errorf("peer does not support batching (set `batch_size` to 0)")
+	}
+	if p.codec != wire.CodecNone && !h.Has(wire.CodecName(p.codec)) {
+		return fmt.Errorf("peer does not support compression %s", wire.CodecName(p.codec))
+	}
+	if l.needsFragments() && !h.Has(wire.FeatureFragment) {
+		return fmt.Errorf("peer does not support fragmentation (raise `max_message_size` above the mtu)")
+	}
+
+	for _, a := range h.Addresses {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return fmt.Errorf("invalid tunnel address %q", a)
+		}
+		for _, addr := range l.addresses() {
+			if addr.IP.Equal(ip) {
+				return fmt.Errorf("peer uses the same tunnel address %s", ip)
+			}
+		}
+		if l.table.Lookup(ip) != p {
+			return fmt.Errorf("tunnel address %s of the peer is not in its allowed_ips", ip)
+		}
+	}
+
+	return nil
+}
+
+// needsFragments reports whether messages may exceed the maximum message
+// size.
+func (l *Link) needsFragments() bool {
+	return l.getMTU()+wire.HeaderLen > l.maxMessageSize || l.conf.BatchSize+wire.HeaderLen > l.maxMessageSize
+}
+
+// mismatch logs why the handshake with peer p failed, unless the same reason
+// has been logged before.
+func (l *Link) mismatch(p *peer, err error) {
+	p.mu.Lock()
+	logged := p.mismatch == err.Error()
+	p.mismatch = err.Error()
+	p.mu.Unlock()
+	if !logged {
+		log.Printf("Handshake with peer %s failed: %v. No traffic is exchanged with the peer.\n", p.address, err)
+	}
+}
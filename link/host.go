@@ -0,0 +1,340 @@
+//go:build linux
+
+package link
+
+import (
+	"sync"
+
+	"github.com/lorenzosaino/go-sysctl"
+	"github.com/omani/nkn-link/config"
+	"github.com/omani/nkn-link/tun"
+	"github.com/vishvananda/netlink"
+)
+
+// host creates the TUN device of a link and applies every change the link
+// makes to the network configuration of the host: addresses, the mtu,
+// sysctls, routes, rules and DNS servers.
+type host interface {
+	routeBackend
+
+	// open creates the device of the link with the given mtu and sets the
+	// device and tunLink of the link.
+	open(mtu int) error
+	// close rolls back the changes made so far.
+	close() error
+
+	addAddr(addr *netlink.Addr) error
+	delAddr(addr *netlink.Addr)
+	setMTU(mtu int) error
+	setSysctl(key, value string) error
+	setDNS(servers []string) error
+	addRule(rule *netlink.Rule) error
+
+	// routes returns the routes of the given family in the main table.
+	routes(family int) ([]netlink.Route, error)
+	// removeRoute removes a route of the host. It is added again on close.
+	removeRoute(route *netlink.Route) error
+}
+
+// netlinkHost creates a TUN device and configures the host through netlink.
+// Every change is recorded in the journal and rolled back on close.
+type netlinkHost struct {
+	l       *Link
+	journal *journal
+}
+
+// open creates the TUN device, rolling back the changes of a previous run
+// that did not exit cleanly, and pins the seed RPC servers.
+func (h *netlinkHost) open(mtu int) error {
+	l := h.l
+	var err error
+	h.journal, err = openJournal(l.conf.GetJournalFile())
+	if err != nil {
+		return err
+	}
+	err = h.journal.record(&change{Op: opLink, Link: l.conf.TunDeviceName})
+	if err != nil {
+		return err
+	}
+
+	device, err := createTUN(l.conf.TunDeviceName, mtu, l.conf.TunNoPI)
+	if err != nil {
+		return err
+	}
+	l.device = device
+
+	name, err := device.Name()
+	if err != nil {
+		return err
+	}
+	if name != l.conf.TunDeviceName {
+		err = h.journal.record(&change{Op: opLink, Link: name})
+		if err != nil {
+			return err
+		}
+	}
+
+	l.tunLink, err = netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	err = netlink.LinkSetUp(l.tunLink)
+	if err != nil {
+		return err
+	}
+
+	// resolve the seed RPC servers while DNS is still reachable. a client
+	// may get a default route from the server.
+	if l.conf.DefaultRouteEnable || l.mode == config.ModeClient {
+		return l.pinSeeds()
+	}
+	return nil
+}
+
+// close rolls back all changes recorded in the journal: it restores the
+// original routes and sysctls, removes the DNS servers and deletes the TUN
+// device.
+func (h *netlinkHost) close() error {
+	if h.journal == nil {
+		return nil
+	}
+	return h.journal.rollback()
+}
+
+// addAddr adds addr to the TUN device.
+func (h *netlinkHost) addAddr(addr *netlink.Addr) error {
+	c := &change{Op: opAddr, Link: h.l.tunLink.Attrs().Name, Addr: formatAddress(addr)}
+	err := h.journal.record(c)
+	if err != nil {
+		return err
+	}
+	err = netlink.AddrAdd(h.l.tunLink, addr)
+	if err != nil {
+		h.journal.forget(c)
+	}
+	return err
+}
+
+// delAddr removes an address added by addAddr.
+func (h *netlinkHost) delAddr(addr *netlink.Addr) {
+	netlink.AddrDel(h.l.tunLink, addr)
+	c := h.journal.find(func(c *change) bool {
+		return c.Op == opAddr && c.Addr == formatAddress(addr)
+	})
+	if c != nil {
+		h.journal.forget(c)
+	}
+}
+
+// setMTU sets the mtu of the TUN device. The device is deleted on close.
+func (h *netlinkHost) setMTU(mtu int) error {
+	return netlink.LinkSetMTU(h.l.tunLink, mtu)
+}
+
+// setSysctl sets the sysctl key to value. The previous value is restored on
+// close.
+func (h *netlinkHost) setSysctl(key, value string) error {
+	old, err := sysctl.Get(key)
+	if err != nil {
+		return err
+	}
+	if old == value {
+		return nil
+	}
+	c := &change{Op: opSysctl, Key: key, Value: old}
+	err = h.journal.record(c)
+	if err != nil {
+		return err
+	}
+	err = sysctl.Set(key, value)
+	if err != nil {
+		h.journal.forget(c)
+	}
+	return err
+}
+
+// setDNS registers the DNS servers of the TUN device. They are removed on
+// close.
+func (h *netlinkHost) setDNS(servers []string) error {
+	name := h.l.tunLink.Attrs().Name
+	c := &change{Op: opDNS, Link: name}
+	err := h.journal.record(c)
+	if err != nil {
+		return err
+	}
+	err = setDNS(name, servers)
+	if err != nil {
+		h.journal.forget(c)
+	}
+	return err
+}
+
+// addRule adds an ip rule. It is removed on close.
+func (h *netlinkHost) addRule(rule *netlink.Rule) error {
+	c := &change{Op: opRuleAdd, Rule: newJournalRule(rule)}
+	err := h.journal.record(c)
+	if err != nil {
+		return err
+	}
+	err = netlink.RuleAdd(rule)
+	if err != nil {
+		h.journal.forget(c)
+	}
+	return err
+}
+
+// routes lists the routes of the given family in the main table.
+func (h *netlinkHost) routes(family int) ([]netlink.Route, error) {
+	return netlink.RouteList(nil, family)
+}
+
+// addRoute adds route. It is removed on close.
+func (h *netlinkHost) addRoute(route netlink.Route) error {
+	c := &change{Op: opRouteAdd, Route: newJournalRoute(&route)}
+	err := h.journal.record(c)
+	if err != nil {
+		return err
+	}
+	err = netlink.RouteAdd(&route)
+	if err != nil {
+		h.journal.forget(c)
+	}
+	return err
+}
+
+// delRoute removes a route added by addRoute.
+func (h *netlinkHost) delRoute(route netlink.Route) {
+	netlink.RouteDel(&route)
+	r := newJournalRoute(&route)
+	c := h.journal.find(func(c *change) bool {
+		return c.Op == opRouteAdd && c.Route.equal(r)
+	})
+	if c != nil {
+		h.journal.forget(c)
+	}
+}
+
+// removeRoute removes a route of the host. It is added again on close.
+func (h *netlinkHost) removeRoute(route *netlink.Route) error {
+	c := &change{Op: opRouteDel, Route: newJournalRoute(route)}
+	err := h.journal.record(c)
+	if err != nil {
+		return err
+	}
+	err = netlink.RouteDel(route)
+	if err != nil {
+		h.journal.forget(c)
+	}
+	return err
+}
+
+// deviceHost hands a given device to the link and records the changes to
+// the network configuration instead of applying them. The host appears to
+// have no routes of its own.
+type deviceHost struct {
+	l      *Link
+	device tun.Device
+
+	mu      sync.Mutex
+	mtu     int
+	addrs   []string          // addresses of the device, formatted
+	sysctls map[string]string // sysctls by key
+	dns     []string
+	rules   []*netlink.Rule
+	added   []netlink.Route // routes added by the link
+}
+
+func newDeviceHost(l *Link, device tun.Device) *deviceHost {
+	return &deviceHost{
+		l:       l,
+		device:  device,
+		sysctls: make(map[string]string),
+	}
+}
+
+func (h *deviceHost) open(mtu int) error {
+	name, err := h.device.Name()
+	if err != nil {
+		return err
+	}
+	h.l.device = h.device
+	h.l.tunLink = &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: name, MTU: mtu}}
+	h.mtu = mtu
+	return nil
+}
+
+func (h *deviceHost) close() error {
+	return nil
+}
+
+func (h *deviceHost) addAddr(addr *netlink.Addr) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.addrs = append(h.addrs, formatAddress(addr))
+	return nil
+}
+
+func (h *deviceHost) delAddr(addr *netlink.Addr) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, a := range h.addrs {
+		if a == formatAddress(addr) {
+			h.addrs = append(h.addrs[:i], h.addrs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (h *deviceHost) setMTU(mtu int) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.mtu = mtu
+	return nil
+}
+
+func (h *deviceHost) setSysctl(key, value string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sysctls[key] = value
+	return nil
+}
+
+func (h *deviceHost) setDNS(servers []string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dns = append([]string(nil), servers...)
+	return nil
+}
+
+func (h *deviceHost) addRule(rule *netlink.Rule) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rules = append(h.rules, rule)
+	return nil
+}
+
+func (h *deviceHost) routes(family int) ([]netlink.Route, error) {
+	return nil, nil
+}
+
+func (h *deviceHost) addRoute(route netlink.Route) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.added = append(h.added, route)
+	return nil
+}
+
+func (h *deviceHost) delRoute(route netlink.Route) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, r := range h.added {
+		if r.Dst.String() == route.Dst.String() && r.Table == route.Table && r.Priority == route.Priority {
+			h.added = append(h.added[:i], h.added[i+1:]...)
+			return
+		}
+	}
+}
+
+func (h *deviceHost) removeRoute(route *netlink.Route) error {
+	return nil
+}
@@ -0,0 +1,517 @@
+//go:build linux
+
+package link
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/lorenzosaino/go-sysctl"
+	"github.com/vishvananda/netlink"
+)
+
+// journal operations
+const (
+	opLink     = "link"      // TUN device created, undone by deleting it
+	opAddr     = "addr"      // address added, undone by deleting it
+	opRouteAdd = "route_add" // route added, undone by deleting it
+	opRouteDel = "route_del" // route deleted, undone by adding it again
+	opRuleAdd  = "rule_add"  // ip rule added, undone by deleting it
+	opSysctl   = "sysctl"    // sysctl changed, undone by restoring its previous value
+	opDNS      = "dns"       // DNS servers registered, undone by removing them
+)
+
+// change is a change to the network configuration of the host as recorded
+// in the journal.
+type change struct {
+	Op    string        `json:"op"`
+	Link  string        `json:"link,omitempty"`
+	Addr  string        `json:"addr,omitempty"`
+	Route *journalRoute `json:"route,omitempty"`
+	Rule  *journalRule  `json:"rule,omitempty"`
+	Key   string        `json:"key,omitempty"`
+	Value string        `json:"value,omitempty"` // previous value of a sysctl
+}
+
+// journalRoute is a route in a form that survives a restart: its device is
+// referenced by name instead of index.
+type journalRoute struct {
+	Link     string `json:"link,omitempty"`
+	Dst      string `json:"dst,omitempty"`
+	Src      string `json:"src,omitempty"`
+	Gw       string `json:"gw,omitempty"`
+	Scope    int    `json:"scope,omitempty"`
+	Protocol int    `json:"protocol,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	Table    int    `json:"table,omitempty"`
+	Type     int    `json:"type,omitempty"`
+	Flags    int    `json:"flags,omitempty"` // e.g. onlink
+
+	MultiPath []*journalNexthop `json:"multipath,omitempty"`
+}
+
+// journalNexthop is a nexthop of a multipath route as recorded in the
+// journal.
+type journalNexthop struct {
+	Link  string `json:"link,omitempty"`
+	Gw    string `json:"gw,omitempty"`
+	Hops  int    `json:"hops,omitempty"` // weight minus one
+	Flags int    `json:"flags,omitempty"`
+}
+
+// journalRule is an ip rule as recorded in the journal.
+type journalRule struct {
+	Family            int    `json:"family"`
+	Priority          int    `json:"priority"`
+	Table             int    `json:"table"`
+	Mark              uint32 `json:"mark,omitempty"`
+	Invert            bool   `json:"invert,omitempty"`
+	SuppressPrefixlen int    `json:"suppress_prefixlen"`
+	UIDRange          string `json:"uidrange,omitempty"` // start-end
+}
+
+// journal records every change to the network configuration of the host in
+// a file before it is made, so that all changes can be rolled back, even by
+// the next run if this one crashed.
+type journal struct {
+	path string
+	lock *os.File // lock file held while the journal is in use
+
+	mu      sync.Mutex
+	changes []*change
+}
+
+// openJournal returns a new, empty journal saved to path. A stale journal
+// left at path by a previous run is rolled back first. It fails if another
+// instance uses the journal.
+func openJournal(path string) (*journal, error) {
+	lock, err := lockJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	stale, err := loadJournal(path)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	if len(stale.changes) > 0 {
+		log.Printf("Found journal %s of a previous run. Restoring the network configuration.\n", path)
+		stale.rollback()
+	}
+	return &journal{path: path, lock: lock}, nil
+}
+
+// lockJournal takes an exclusive lock on the lock file of the journal at
+// path. The lock is released when the returned file is closed or the process
+// exits.
+func lockJournal(path string) (*os.File, error) {
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		f.Close()
+		return nil, fmt.Errorf("journal %s is in use by another running nkn-link", path)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// loadJournal reads the journal at path. A missing file is an empty
+// journal.
+func loadJournal(path string) (*journal, error) {
+	j := &journal{path: path}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &j.changes)
+	if err != nil {
+		return nil, fmt.Errorf("journal %s: %w", path, err)
+	}
+	return j, nil
+}
+
+// Recover rolls back the changes recorded in the journal at path by a run
+// that did not exit cleanly.
+func Recover(path string) error {
+	lock, err := lockJournal(path)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	j, err := loadJournal(path)
+	if err != nil {
+		return err
+	}
+	if len(j.changes) == 0 {
+		log.Printf("No changes recorded in %s. Nothing to clean up.\n", path)
+		return nil
+	}
+	return j.rollback()
+}
+
+// record adds c to the journal and saves it.
+func (j *journal) record(c *change) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.changes = append(j.changes, c)
+	return j.save()
+}
+
+// forget removes c from the journal, once it has been undone or failed.
+func (j *journal) forget(c *change) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i, r := range j.changes {
+		if r == c {
+			j.changes = append(j.changes[:i], j.changes[i+1:]...)
+			break
+		}
+	}
+	if err := j.save(); err != nil {
+		log.Printf("Could not save journal: %v\n", err)
+	}
+}
+
+// find returns the last recorded change matching match, or nil.
+func (j *journal) find(match func(c *change) bool) *change {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i := len(j.changes) - 1; i >= 0; i-- {
+		if match(j.changes[i]) {
+			return j.changes[i]
+		}
+	}
+	return nil
+}
+
+// rollback undoes all recorded changes in reverse order and removes the
+// journal. Changes that cannot be undone are logged.
+func (j *journal) rollback() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var err error
+	for i := len(j.changes) - 1; i >= 0; i-- {
+		if e := undo(j.changes[i]); e != nil {
+			log.Printf("Could not undo %s: %v\n", j.changes[i], e)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	j.changes = nil
+
+	if e := os.Remove(j.path); e != nil && !os.IsNotExist(e) && err == nil {
+		err = e
+	}
+	if j.lock != nil {
+		j.lock.Close()
+		j.lock = nil
+	}
+	return err
+}
+
+// save writes the journal to its file, replacing it atomically. An empty
+// journal removes the file.
+func (j *journal) save() error {
+	if len(j.changes) == 0 {
+		err := os.Remove(j.path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	b, err := json.MarshalIndent(j.changes, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(j.path), filepath.Base(j.path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), j.path)
+}
+
+func (c *change) String() string {
+	switch c.Op {
+	case opLink:
+		return "creation of device " + c.Link
+	case opAddr:
+		return fmt.Sprintf("address %s of %s", c.Addr, c.Link)
+	case opRouteAdd:
+		return "addition of route " + c.Route.String()
+	case opRouteDel:
+		return "deletion of route " + c.Route.String()
+	case opRuleAdd:
+		return "addition of rule " + c.Rule.String()
+	case opSysctl:
+		return "sysctl " + c.Key
+	case opDNS:
+		return "DNS servers of " + c.Link
+	default:
+		return c.Op
+	}
+}
+
+// undo reverts a recorded change. Changes that are already gone, like routes
+// of a deleted device, are no error.
+func undo(c *change) error {
+	switch c.Op {
+	case opLink:
+		link, err := netlink.LinkByName(c.Link)
+		if err != nil {
+			return nil
+		}
+		return netlink.LinkDel(link)
+	case opAddr:
+		link, err := netlink.LinkByName(c.Link)
+		if err != nil {
+			return nil
+		}
+		addr, err := parseAddress(c.Addr)
+		if err != nil {
+			return err
+		}
+		netlink.AddrDel(link, addr)
+		return nil
+	case opRouteAdd:
+		route, err := c.Route.route()
+		if err != nil {
+			return nil
+		}
+		netlink.RouteDel(route)
+		return nil
+	case opRouteDel:
+		route, err := c.Route.route()
+		if err != nil {
+			return err
+		}
+		err = netlink.RouteAdd(route)
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	case opRuleAdd:
+		err := netlink.RuleDel(c.Rule.rule())
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	case opSysctl:
+		return sysctl.Set(c.Key, c.Value)
+	case opDNS:
+		return unsetDNS(c.Link)
+	default:
+		return fmt.Errorf("unknown operation %q", c.Op)
+	}
+}
+
+// newJournalRoute converts route for the journal.
+func newJournalRoute(route *netlink.Route) *journalRoute {
+	r := &journalRoute{
+		Scope:    int(route.Scope),
+		Protocol: int(route.Protocol),
+		Priority: route.Priority,
+		Table:    route.Table,
+		Type:     route.Type,
+		Flags:    route.Flags,
+	}
+	r.Link = linkName(route.LinkIndex)
+	if route.Dst != nil {
+		r.Dst = route.Dst.String()
+	}
+	if route.Src != nil {
+		r.Src = route.Src.String()
+	}
+	if route.Gw != nil {
+		r.Gw = route.Gw.String()
+	}
+	for _, nh := range route.MultiPath {
+		n := &journalNexthop{
+			Link:  linkName(nh.LinkIndex),
+			Hops:  nh.Hops,
+			Flags: nh.Flags,
+		}
+		if nh.Gw != nil {
+			n.Gw = nh.Gw.String()
+		}
+		r.MultiPath = append(r.MultiPath, n)
+	}
+	return r
+}
+
+// linkName returns the name of the device with the given index, or an empty
+// string.
+func linkName(index int) string {
+	if index <= 0 {
+		return ""
+	}
+	link, err := netlink.LinkByIndex(index)
+	if err != nil {
+		return ""
+	}
+	return link.Attrs().Name
+}
+
+// linkIndex returns the index of the device with the given name, or 0 if
+// name is empty.
+func linkIndex(name string) (int, error) {
+	if len(name) == 0 {
+		return 0, nil
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return link.Attrs().Index, nil
+}
+
+// route converts r back into a route. It fails if the device of the route
+// does not exist anymore.
+func (r *journalRoute) route() (*netlink.Route, error) {
+	route := &netlink.Route{
+		Scope:    netlink.Scope(r.Scope),
+		Protocol: netlink.RouteProtocol(r.Protocol),
+		Priority: r.Priority,
+		Table:    r.Table,
+		Type:     r.Type,
+		Flags:    r.Flags,
+		Src:      net.ParseIP(r.Src),
+		Gw:       net.ParseIP(r.Gw),
+	}
+	var err error
+	route.LinkIndex, err = linkIndex(r.Link)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range r.MultiPath {
+		nh := &netlink.NexthopInfo{
+			Hops:  n.Hops,
+			Flags: n.Flags,
+			Gw:    net.ParseIP(n.Gw),
+		}
+		nh.LinkIndex, err = linkIndex(n.Link)
+		if err != nil {
+			return nil, err
+		}
+		route.MultiPath = append(route.MultiPath, nh)
+	}
+	if len(r.Dst) > 0 {
+		_, dst, err := net.ParseCIDR(r.Dst)
+		if err != nil {
+			return nil, err
+		}
+		route.Dst = dst
+	}
+	return route, nil
+}
+
+func (r *journalRoute) String() string {
+	s := r.Dst
+	if len(s) == 0 {
+		s = "default"
+	}
+	if len(r.Gw) > 0 {
+		s += " via " + r.Gw
+	}
+	if len(r.Link) > 0 {
+		s += " dev " + r.Link
+	}
+	for _, n := range r.MultiPath {
+		s += " nexthop"
+		if len(n.Gw) > 0 {
+			s += " via " + n.Gw
+		}
+		if len(n.Link) > 0 {
+			s += " dev " + n.Link
+		}
+	}
+	if r.Priority > 0 {
+		s += fmt.Sprintf(" metric %d", r.Priority)
+	}
+	return s
+}
+
+// equal reports whether r and o record the same route.
+func (r *journalRoute) equal(o *journalRoute) bool {
+	return reflect.DeepEqual(r, o)
+}
+
+// newJournalRule converts rule for the journal.
+func newJournalRule(rule *netlink.Rule) *journalRule {
+	r := &journalRule{
+		Family:            rule.Family,
+		Priority:          rule.Priority,
+		Table:             rule.Table,
+		Mark:              rule.Mark,
+		Invert:            rule.Invert,
+		SuppressPrefixlen: rule.SuppressPrefixlen,
+	}
+	if rule.UIDRange != nil {
+		r.UIDRange = fmt.Sprintf("%d-%d", rule.UIDRange.Start, rule.UIDRange.End)
+	}
+	return r
+}
+
+// rule converts r back into an ip rule.
+func (r *journalRule) rule() *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Family = r.Family
+	rule.Priority = r.Priority
+	rule.Table = r.Table
+	rule.Mark = r.Mark
+	rule.Invert = r.Invert
+	rule.SuppressPrefixlen = r.SuppressPrefixlen
+	if len(r.UIDRange) > 0 {
+		rule.UIDRange, _ = parseUIDRange(r.UIDRange)
+	}
+	return rule
+}
+
+func (r *journalRule) String() string {
+	s := ""
+	if r.Invert {
+		s += "not "
+	}
+	if r.Mark != 0 {
+		s += fmt.Sprintf("fwmark %#x ", r.Mark)
+	}
+	if len(r.UIDRange) > 0 {
+		s += "uidrange " + r.UIDRange + " "
+	}
+	s += fmt.Sprintf("table %d", r.Table)
+	if r.SuppressPrefixlen >= 0 {
+		s += fmt.Sprintf(" suppress_prefixlength %d", r.SuppressPrefixlen)
+	}
+	return s
+}
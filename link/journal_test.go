@@ -0,0 +1,62 @@
+//go:build linux
+
+package link
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestJournalRouteRoundTrip(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("192.168.10.0/24")
+	routes := []*netlink.Route{
+		{
+			Gw:       net.ParseIP("192.168.1.1"),
+			Flags:    int(netlink.FLAG_ONLINK),
+			Priority: 100,
+			Protocol: 4,
+		},
+		{
+			Dst:   dst,
+			Table: 100,
+			MultiPath: []*netlink.NexthopInfo{
+				{Gw: net.ParseIP("10.0.0.1"), Hops: 1, Flags: int(netlink.FLAG_ONLINK)},
+				{Gw: net.ParseIP("10.0.0.2")},
+			},
+		},
+	}
+	for _, want := range routes {
+		b, err := json.Marshal(&change{Op: opRouteDel, Route: newJournalRoute(want)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c change
+		err = json.Unmarshal(b, &c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.Route.equal(newJournalRoute(want)) {
+			t.Errorf("journal route %s changed by the round trip", c.Route)
+		}
+		got, err := c.Route.route()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Flags != want.Flags || !got.Gw.Equal(want.Gw) || got.Priority != want.Priority ||
+			got.Protocol != want.Protocol || got.Table != want.Table || got.Dst.String() != want.Dst.String() {
+			t.Errorf("route %s restored as %s", want, got)
+		}
+		if len(got.MultiPath) != len(want.MultiPath) {
+			t.Fatalf("route %s restored with %d nexthops", want, len(got.MultiPath))
+		}
+		for i, nh := range want.MultiPath {
+			if !got.MultiPath[i].Gw.Equal(nh.Gw) || got.MultiPath[i].Hops != nh.Hops || got.MultiPath[i].Flags != nh.Flags {
+				t.Errorf("nexthop %s restored as %s", nh, got.MultiPath[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+//go:build linux
+
+package link
+
+import (
+	"log"
+	"time"
+
+	"github.com/omani/nkn-link/wire"
+)
+
+// keepalive pings every peer at the keepalive interval and marks peers down
+// that stayed silent for longer than the keepalive timeout.
+func (l *Link) keepalive() {
+	defer l.wg.Done()
+
+	timeout := l.conf.GetKeepaliveTimeout()
+	ticker := time.NewTicker(l.conf.GetKeepaliveInterval())
+	defer ticker.Stop()
+
+	l.greetPending()
+	l.ping()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case now := <-ticker.C:
+			for _, p := range l.peerList() {
+				if p.expire(now.Add(-timeout), l.epoch) {
+					_, last, _ := p.status()
+					if last.IsZero() {
+						log.Printf("Peer %s is down: no answer within %s.\n", p.address, timeout)
+					} else {
+						log.Printf("Peer %s is down: last seen %s ago.\n", p.address, now.Sub(last).Round(time.Millisecond))
+					}
+					// negotiate again once the peer is back
+					p.setReady(false)
+					l.removeSubnets(p)
+					l.notify(p, PeerDown)
+				}
+			}
+			if l.pool != nil {
+				l.expireClients(now)
+			}
+			l.greetPending()
+			l.ping()
+		}
+	}
+}
+
+// greetPending sends the handshake to every peer the handshake has not been
+// completed with.
+func (l *Link) greetPending() {
+	for _, p := range l.peerList() {
+		if !p.isReady() {
+			l.greet(p, false)
+		}
+	}
+}
+
+// ping sends a keepalive ping to every peer, stamped with the time since
+// the start of the link.
+func (l *Link) ping() {
+	stamp := uint64(time.Since(l.epoch))
+	for _, p := range l.peerList() {
+		if !l.sendMessage(p, wire.Keepalive(wire.KeepalivePing, stamp)) {
+			return
+		}
+	}
+}
+
+// handleKeepalive answers a ping of peer p or measures the round-trip time
+// from a pong.
+func (l *Link) handleKeepalive(p *peer, msg []byte) {
+	kind, stamp, err := wire.ParseKeepalive(msg)
+	if err != nil {
+		l.invalid(p, err)
+		return
+	}
+
+	switch kind {
+	case wire.KeepalivePing:
+		l.sendMessage(p, wire.Keepalive(wire.KeepalivePong, stamp))
+	case wire.KeepalivePong:
+		rtt := time.Since(l.epoch) - time.Duration(stamp)
+		if rtt < 0 {
+			return
+		}
+		p.mu.Lock()
+		p.rtt = rtt
+		p.mu.Unlock()
+	}
+}
+
+// seen records that a message was received from peer p.
+func (l *Link) seen(p *peer) {
+	old := p.seen(time.Now())
+	if old != PeerUp {
+		log.Printf("Peer %s is up.\n", p.address)
+		l.notify(p, PeerUp)
+		if !p.isReady() {
+			l.greet(p, false)
+		}
+	}
+}
+
+// notify calls the registered handlers with the new state of peer p.
+func (l *Link) notify(p *peer, state PeerState) {
+	l.mu.Lock()
+	handlers := l.handlers
+	l.mu.Unlock()
+	for _, fn := range handlers {
+		fn(p.address, state)
+	}
+}
@@ -0,0 +1,328 @@
+//go:build linux
+
+// Package link implements the nkn-link tunnel engine. A Link owns the TUN
+// device, the transport to the remote peer and all changes made to the
+// network configuration of the host, and undoes them when it is closed. The
+// package configures the host through netlink and only builds on Linux.
+//
+// With `default_route_mode: policy`, the sockets of the NKN transport must
+// be marked before the transport is created, see transport.MarkSockets. It
+// changes http.DefaultTransport and websocket.DefaultDialer, so it marks the
+// sockets of every other user of those in the process as well.
+package link
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omani/nkn-link/config"
+	"github.com/omani/nkn-link/lease"
+	"github.com/omani/nkn-link/transport"
+	"github.com/omani/nkn-link/tun"
+	"github.com/omani/nkn-link/wire"
+	"github.com/vishvananda/netlink"
+)
+
+// ErrStarted is returned by Start if the link has already been started.
+var ErrStarted = errors.New("link already started")
+
+// Link is a tunnel between the local TUN device and one or more remote peers
+// reachable over a transport.
+type Link struct {
+	counters   counters // first for 64-bit alignment of the atomic counters
+	fragmentID uint32   // id of the last message split into fragments
+	mtu        uint32   // mtu of the TUN device, changed by the profile of a server
+
+	// Debug enables the dump of every packet sent and received.
+	Debug bool
+
+	conf      *config.Config
+	transport transport.Transport
+
+	host    host // creates the device and configures the host around it
+	device  tun.Device
+	tunLink netlink.Link
+
+	mode    string
+	pool    *lease.Pool   // leases addresses to clients in server mode
+	mesh    *mesh         // routes learned from announcements in mesh mode
+	codec   byte          // codec compressing messages sent to peers added at runtime
+	profile *wire.Profile // configuration pushed to clients in server mode
+
+	peersMu sync.RWMutex
+	peers   []*peer
+	byKey   map[string]*peer // peers by public key, the allow-list of senders
+	table   *allowedIPs      // routes packets to peers by destination
+
+	maxMessageSize int
+	reassembler    *reassembler
+	rxbuf          []byte // buffer of the rx goroutine for writes to the device
+
+	addrs     []*netlink.Addr         // addresses of the TUN device, guarded by mu
+	includes  []*net.IPNet            // route_include
+	excludes  []*net.IPNet            // route_exclude
+	uidRanges []*netlink.RuleUIDRange // tunnel_uids
+
+	epoch    time.Time // start of the link, reference of keepalive stamps
+	handlers []func(address string, state PeerState)
+
+	bypassRoutes *bypassRoutes // routes keeping the NKN nodes out of the tunnel
+
+	mu           sync.Mutex
+	started      bool
+	profileSet   bool            // whether the profile of the server has been applied
+	profileSteps map[string]bool // steps of the profile applied so far, only used by rx
+
+	wg       sync.WaitGroup
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	errOnce  sync.Once
+	err      error
+}
+
+// New returns a link for the given configuration. The link takes ownership
+// of the transport and closes it when the link is closed.
+func New(conf *config.Config, t transport.Transport) *Link {
+	return newLink(conf, t, func(l *Link) host {
+		return &netlinkHost{l: l}
+	})
+}
+
+// NewWithDevice returns a link forwarding packets between the given device
+// and the transport. The link neither creates a TUN device nor changes the
+// network configuration of the host, so the data path can be tested and
+// benchmarked without privileges, e.g. over a transport.LoopbackNetwork.
+// The link takes ownership of the device and the transport.
+func NewWithDevice(conf *config.Config, t transport.Transport, device tun.Device) *Link {
+	return newLink(conf, t, func(l *Link) host {
+		return newDeviceHost(l, device)
+	})
+}
+
+func newLink(conf *config.Config, t transport.Transport, newHost func(l *Link) host) *Link {
+	l := &Link{
+		conf:      conf,
+		transport: t,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	l.host = newHost(l)
+	l.bypassRoutes = newBypassRoutes(l.host)
+	return l
+}
+
+// Start creates and configures the TUN device and starts forwarding packets
+// between the device and the transport. The link runs until ctx is done,
+// Close is called or an error occurs. If Start fails, every change made so
+// far is rolled back and the transport is closed.
+func (l *Link) Start(ctx context.Context) error {
+	l.mu.Lock()
+	if l.started {
+		l.mu.Unlock()
+		return ErrStarted
+	}
+	l.started = true
+	l.epoch = time.Now()
+	l.mu.Unlock()
+
+	err := l.setup()
+	if err != nil {
+		l.fail(err)
+		l.teardown()
+		return err
+	}
+
+	l.wg.Add(4)
+	go l.tx()
+	go l.rx()
+	go l.bypass()
+	go l.keepalive()
+	if l.mesh != nil {
+		l.wg.Add(1)
+		go l.gossip()
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-l.stop:
+		}
+		l.teardown()
+	}()
+
+	return nil
+}
+
+// Close stops the link and waits until all changes to the host have been
+// rolled back. It returns the error that stopped the link, if any.
+func (l *Link) Close() error {
+	l.mu.Lock()
+	started := l.started
+	l.started = true
+	l.mu.Unlock()
+
+	if !started {
+		l.shutdown()
+		l.transport.Close()
+		close(l.done)
+		return nil
+	}
+
+	l.shutdown()
+	return l.Wait()
+}
+
+// Wait blocks until the link is stopped and returns the error that stopped
+// it. A link stopped by Close or by its context returns nil.
+func (l *Link) Wait() error {
+	<-l.done
+	return l.err
+}
+
+// Stats returns a snapshot of the packet counters of the link.
+func (l *Link) Stats() Stats {
+	return l.counters.stats()
+}
+
+// PeerStats returns a snapshot of the packet counters and the liveness of
+// every peer.
+func (l *Link) PeerStats() []PeerStats {
+	peers := l.peerList()
+	stats := make([]PeerStats, 0, len(peers))
+	for _, p := range peers {
+		s := p.counters.stats(p.address)
+		s.State, s.LastSeen, s.RTT = p.status()
+		s.Ready = p.isReady()
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// OnPeerStateChange registers fn to be called with the address of a peer
+// whenever its state changes. It must be called before Start. fn is called
+// from the goroutines of the link and must not block.
+func (l *Link) OnPeerStateChange(fn func(address string, state PeerState)) {
+	l.mu.Lock()
+	l.handlers = append(l.handlers, fn)
+	l.mu.Unlock()
+}
+
+// peerByAddress returns the configured peer sending from addr, or nil if
+// addr does not belong to any peer.
+func (l *Link) peerByAddress(addr string) *peer {
+	l.peersMu.RLock()
+	defer l.peersMu.RUnlock()
+	return l.byKey[publicKey(addr)]
+}
+
+// peerList returns a snapshot of all peers.
+func (l *Link) peerList() []*peer {
+	l.peersMu.RLock()
+	defer l.peersMu.RUnlock()
+	return append([]*peer(nil), l.peers...)
+}
+
+// addPeer registers peer p and routes its allowed IPs to it.
+func (l *Link) addPeer(p *peer) {
+	if l.conf.BatchSize > 0 {
+		p.batcher = newBatcher(l.conf.BatchSize, l.conf.GetBatchDelay(), func(msg []byte) {
+			l.send(p, msg)
+		})
+	}
+	for _, prefix := range p.allowedIPs {
+		l.table.Insert(prefix, p)
+	}
+
+	l.peersMu.Lock()
+	l.peers = append(l.peers, p)
+	l.byKey[publicKey(p.address)] = p
+	l.peersMu.Unlock()
+}
+
+// getMTU returns the mtu of the TUN device.
+func (l *Link) getMTU() int {
+	return int(atomic.LoadUint32(&l.mtu))
+}
+
+func (l *Link) setMTU(mtu int) {
+	atomic.StoreUint32(&l.mtu, uint32(mtu))
+}
+
+// removePeer removes peer p and the routes of its allowed IPs.
+func (l *Link) removePeer(p *peer) {
+	for _, prefix := range p.allowedIPs {
+		l.table.Remove(prefix, p)
+	}
+
+	l.peersMu.Lock()
+	defer l.peersMu.Unlock()
+	for i, q := range l.peers {
+		if q == p {
+			l.peers = append(l.peers[:i], l.peers[i+1:]...)
+			break
+		}
+	}
+	if l.byKey[publicKey(p.address)] == p {
+		delete(l.byKey, publicKey(p.address))
+	}
+}
+
+// addresses returns a snapshot of the addresses of the TUN device.
+func (l *Link) addresses() []*netlink.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]*netlink.Addr(nil), l.addrs...)
+}
+
+// shutdown signals all goroutines of the link to stop.
+func (l *Link) shutdown() {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+	})
+}
+
+// stopping reports whether the link is shutting down.
+func (l *Link) stopping() bool {
+	select {
+	case <-l.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// fail records err as the reason the link stopped and shuts it down. Only
+// the first error is kept.
+func (l *Link) fail(err error) {
+	l.errOnce.Do(func() {
+		l.err = err
+	})
+	l.shutdown()
+}
+
+// teardown closes the device and the transport, waits for the forwarding
+// goroutines and rolls back the network configuration.
+func (l *Link) teardown() {
+	l.shutdown()
+
+	// let the other nodes of a mesh know before the transport is gone
+	if l.mesh != nil {
+		l.withdraw()
+	}
+
+	if l.device != nil {
+		l.device.Close()
+	}
+	l.transport.Close()
+	l.wg.Wait()
+
+	if err := l.cleanup(); err != nil {
+		l.fail(err)
+	}
+	close(l.done)
+}
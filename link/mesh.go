@@ -0,0 +1,366 @@
+//go:build linux
+
+package link
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/omani/nkn-link/wire"
+)
+
+// mesh holds the routes of a mesh node. Every node originates a route with
+// its NKN address, tunnel addresses and advertised subnets and announces it
+// to all nodes it knows. Routes newer than the known ones are forwarded to
+// all other nodes, so they spread until every node knows every other node
+// and talks to it directly. Sequence numbers stop the flooding of routes
+// that are already known, including those coming back in loops.
+type mesh struct {
+	interval time.Duration // how often the own route is announced
+	expiry   time.Duration // how long routes stay valid without announcement
+
+	mu        sync.Mutex
+	self      wire.Route            // route originated by this node
+	announced bool                  // whether the own route has been announced
+	routes    map[string]*meshRoute // routes of the other nodes by public key
+}
+
+type meshRoute struct {
+	route   wire.Route
+	updated time.Time // when the route was learned or withdrawn
+}
+
+// setupMesh creates the mesh state.
+func (l *Link) setupMesh() error {
+	if len(l.conf.MeshMembers) == 0 {
+		return errors.New("mesh mode needs `mesh_members`")
+	}
+	interval := l.conf.GetAnnounceInterval()
+	l.mesh = &mesh{
+		interval: interval,
+		expiry:   3 * interval,
+		self: wire.Route{
+			Origin:  l.transport.Address(),
+			Seq:     uint64(time.Now().UnixNano()), // keeps increasing across restarts
+			Subnets: l.conf.AdvertisedSubnets,
+		},
+		routes: make(map[string]*meshRoute),
+	}
+	return nil
+}
+
+// gossip announces the routes of the mesh at the announce interval and
+// expires routes that have not been announced for too long.
+func (l *Link) gossip() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.mesh.interval)
+	defer ticker.Stop()
+
+	l.refresh()
+	l.announce(l.peerList(), l.meshRoutes())
+	for {
+		select {
+		case <-l.stop:
+			return
+		case now := <-ticker.C:
+			l.expireRoutes(now)
+			l.refresh()
+			l.announce(l.peerList(), l.meshRoutes())
+		}
+	}
+}
+
+// refresh increases the sequence number of the own route and updates its
+// addresses.
+func (l *Link) refresh() {
+	var addrs []string
+	for _, addr := range l.addresses() {
+		addrs = append(addrs, addr.IP.String())
+	}
+
+	m := l.mesh
+	m.mu.Lock()
+	m.self.Seq++
+	m.self.Addresses = addrs
+	m.announced = true
+	m.mu.Unlock()
+}
+
+// meshRoutes returns the own route and all known routes, including
+// withdrawn ones, so that withdrawals spread as well.
+func (l *Link) meshRoutes() []wire.Route {
+	m := l.mesh
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	routes := make([]wire.Route, 0, len(m.routes)+1)
+	routes = append(routes, m.self)
+	for _, mr := range m.routes {
+		routes = append(routes, mr.route)
+	}
+	return routes
+}
+
+// announce sends routes to peers, split into messages of at most the
+// maximum message size.
+func (l *Link) announce(peers []*peer, routes []wire.Route) {
+	var msgs [][]byte
+	var chunk []wire.Route
+	size := 0
+	flush := func() {
+		if len(chunk) == 0 {
+			return
+		}
+		msg, err := wire.EncodeAnnouncement(chunk)
+		if err == nil {
+			msgs = append(msgs, msg)
+		}
+		chunk, size = nil, 0
+	}
+	for _, r := range routes {
+		b, err := json.Marshal(r)
+		if err != nil {
+			continue
+		}
+		// the routes are encoded as JSON array
+		if len(chunk) > 0 && wire.HeaderLen+2+size+len(b) > l.maxMessageSize {
+			flush()
+		}
+		chunk = append(chunk, r)
+		size += len(b) + 1
+	}
+	flush()
+
+	for _, p := range peers {
+		for _, msg := range msgs {
+			if !l.sendMessage(p, msg) {
+				return
+			}
+		}
+	}
+}
+
+// handleAnnounce learns the routes announced by peer p and forwards the new
+// ones to all other peers. Nodes learned for the first time get all known
+// routes and a handshake.
+func (l *Link) handleAnnounce(p *peer, msg []byte) {
+	routes, err := wire.ParseAnnouncement(msg)
+	if err != nil {
+		l.invalid(p, err)
+		return
+	}
+
+	m := l.mesh
+	now := time.Now()
+	var changed []wire.Route
+	var added []*peer
+	for _, r := range routes {
+		if len(r.Origin) == 0 {
+			continue
+		}
+		key := publicKey(r.Origin)
+
+		m.mu.Lock()
+		if key == publicKey(m.self.Origin) {
+			// an announcement of a previous run of this node, outdate it
+			if r.Seq >= m.self.Seq {
+				m.self.Seq = r.Seq + 1
+				changed = append(changed, m.self)
+			}
+			m.mu.Unlock()
+			continue
+		}
+		known := m.routes[key]
+		if (known != nil && r.Seq <= known.route.Seq) || !l.memberAllowed(r.Origin) {
+			m.mu.Unlock()
+			continue
+		}
+		m.routes[key] = &meshRoute{route: r, updated: now}
+		m.mu.Unlock()
+
+		changed = append(changed, r)
+		if r.Withdrawn {
+			l.forget(r.Origin)
+		} else if q := l.learn(r); q != nil {
+			added = append(added, q)
+		}
+	}
+
+	if len(changed) > 0 {
+		var others []*peer
+		for _, q := range l.peerList() {
+			if q != p {
+				others = append(others, q)
+			}
+		}
+		l.announce(others, changed)
+	}
+	for _, q := range added {
+		l.announce([]*peer{q}, l.meshRoutes())
+		l.greet(q, false)
+	}
+}
+
+// learn routes the addresses and subnets of a route to the node it
+// originates from. It returns the peer of the node if it was not known
+// before.
+func (l *Link) learn(r wire.Route) *peer {
+	var prefixes []*net.IPNet
+	for _, a := range r.Addresses {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			continue
+		}
+		prefixes = append(prefixes, hostDst(ip))
+	}
+	for _, cidr := range r.Subnets {
+		_, prefix, err := net.ParseCIDR(cidr)
+		if err == nil {
+			err = checkPrefix(prefix)
+		}
+		if err != nil {
+			log.Printf("Mesh node %s announces invalid subnet %q: %v. Skipping.\n", r.Origin, cidr, err)
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	var added *peer
+	q := l.peerByAddress(r.Origin)
+	if q == nil {
+		q = &peer{
+			address: r.Origin,
+			codec:   l.codec,
+			dynamic: true,
+		}
+		l.addPeer(q)
+		added = q
+		log.Printf("Learned mesh node %s.\n", r.Origin)
+	}
+	l.setLearned(q, prefixes)
+	return added
+}
+
+// forget removes the learned routes of the node with the given address. A
+// node that is not a configured peer is removed completely.
+func (l *Link) forget(origin string) {
+	q := l.peerByAddress(origin)
+	if q == nil {
+		return
+	}
+	l.setLearned(q, nil)
+	l.removeSubnets(q)
+	if q.dynamic {
+		l.removePeer(q)
+		log.Printf("Mesh node %s left.\n", origin)
+	}
+}
+
+// setLearned replaces the prefixes learned for peer q. Prefixes already
+// routed to another peer are skipped.
+func (l *Link) setLearned(q *peer, prefixes []*net.IPNet) {
+	m := l.mesh
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, prefix := range q.learned {
+		l.table.Remove(prefix, q)
+	}
+	q.learned = nil
+	for _, prefix := range prefixes {
+		if owner := l.table.Get(prefix); owner != nil && owner != q {
+			log.Printf("Mesh node %s announces %s, which is routed to %s. Skipping.\n", q.address, prefix, owner.address)
+			continue
+		}
+		l.table.Insert(prefix, q)
+		q.learned = append(q.learned, prefix)
+	}
+}
+
+// expireRoutes withdraws routes that have not been announced within the
+// expiry and drops withdrawn routes after the expiry.
+func (l *Link) expireRoutes(now time.Time) {
+	m := l.mesh
+	var expired []string
+	m.mu.Lock()
+	for key, mr := range m.routes {
+		if now.Sub(mr.updated) <= m.expiry {
+			continue
+		}
+		if mr.route.Withdrawn {
+			delete(m.routes, key)
+			continue
+		}
+		mr.route.Withdrawn = true
+		mr.updated = now
+		expired = append(expired, mr.route.Origin)
+	}
+	m.mu.Unlock()
+
+	for _, origin := range expired {
+		l.forget(origin)
+	}
+}
+
+// withdraw announces that this node leaves the mesh.
+func (l *Link) withdraw() {
+	m := l.mesh
+	m.mu.Lock()
+	if !m.announced {
+		m.mu.Unlock()
+		return
+	}
+	m.self.Seq++
+	m.self.Withdrawn = true
+	self := m.self
+	m.mu.Unlock()
+
+	l.announce(l.peerList(), []wire.Route{self})
+}
+
+// acceptNode registers the sender of a handshake or announcement as a new
+// node of the mesh. It returns nil if the sender is not accepted.
+func (l *Link) acceptNode(src string, msg []byte) *peer {
+	typ, err := wire.Type(msg)
+	if err != nil || (typ != wire.TypeHandshake && typ != wire.TypeAnnounce) || !l.memberAllowed(src) {
+		return nil
+	}
+	p := &peer{
+		address: src,
+		codec:   l.codec,
+		dynamic: true,
+	}
+	l.addPeer(p)
+	log.Printf("Mesh node %s connected.\n", src)
+	return p
+}
+
+// memberAllowed reports whether the node with the given address may join
+// the mesh: it is listed in `mesh_members` or a configured peer.
+func (l *Link) memberAllowed(addr string) bool {
+	key := publicKey(addr)
+	for _, member := range l.conf.MeshMembers {
+		if publicKey(member) == key {
+			return true
+		}
+	}
+	for _, peer := range l.conf.GetPeers() {
+		if publicKey(peer.Address) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// hasLearned reports whether routes have been learned for peer p.
+func (l *Link) hasLearned(p *peer) bool {
+	m := l.mesh
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(p.learned) > 0
+}
@@ -0,0 +1,184 @@
+//go:build linux
+
+package link
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omani/nkn-link/config"
+	"github.com/omani/nkn-link/transport"
+	"github.com/omani/nkn-link/wire"
+)
+
+// recordingTransport is a Transport keeping the announcements it sends.
+type recordingTransport struct {
+	addr string
+
+	mu   sync.Mutex
+	sent map[string][]wire.Route // routes announced by destination
+}
+
+func (t *recordingTransport) Send(dst string, data []byte) error {
+	typ, err := wire.Type(data)
+	if err != nil || typ != wire.TypeAnnounce {
+		return nil
+	}
+	routes, err := wire.ParseAnnouncement(data)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sent[dst] = append(t.sent[dst], routes...)
+	return nil
+}
+
+func (t *recordingTransport) Receive() <-chan *transport.Message { return nil }
+func (t *recordingTransport) Address() string                    { return t.addr }
+func (t *recordingTransport) OnConnect() <-chan *transport.Node  { return nil }
+func (t *recordingTransport) Close() error                       { return nil }
+
+// take returns and clears the routes announced to dst.
+func (t *recordingTransport) take(dst string) []wire.Route {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	routes := t.sent[dst]
+	delete(t.sent, dst)
+	return routes
+}
+
+// newTestMesh sets up mesh node a with the configured peers b and d. The
+// link is not started, announcements are handled by the test.
+func newTestMesh(t *testing.T) (*Link, *recordingTransport) {
+	t.Helper()
+	conf := &config.Config{
+		Mode:               config.ModeMesh,
+		TunDeviceIPAddress: config.StringList{"10.0.0.1/24"},
+		MeshMembers:        []string{"c"},
+		Peers:              []config.PeerConfig{{Address: "b"}, {Address: "d"}},
+	}
+	tr := &recordingTransport{addr: "a", sent: make(map[string][]wire.Route)}
+	l := NewWithDevice(conf, tr, newChanDevice())
+	err := l.setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, tr
+}
+
+// receive hands an announcement of routes from peer p to l.
+func receive(t *testing.T, l *Link, p *peer, routes ...wire.Route) {
+	t.Helper()
+	msg, err := wire.EncodeAnnouncement(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.handleAnnounce(p, msg)
+}
+
+func TestMeshForwarding(t *testing.T) {
+	l, tr := newTestMesh(t)
+	b := l.peerByAddress("b")
+	c := wire.Route{Origin: "c", Seq: 5, Addresses: []string{"10.0.0.3"}}
+
+	receive(t, l, b, c)
+	q := l.peerByAddress("c")
+	if q == nil || l.table.Lookup(net.ParseIP("10.0.0.3")) != q {
+		t.Fatal("route of c not learned")
+	}
+	if routes := tr.take("d"); len(routes) != 1 || routes[0].Origin != "c" {
+		t.Errorf("announced %+v to d, want the route of c", routes)
+	}
+	if routes := tr.take("b"); len(routes) != 0 {
+		t.Errorf("route of c sent back to b: %+v", routes)
+	}
+	// c learns every known route
+	if routes := tr.take("c"); len(routes) < 2 {
+		t.Errorf("announced %+v to c, want all routes", routes)
+	}
+
+	// the same or an older route coming back in a loop is not forwarded
+	receive(t, l, l.peerByAddress("d"), c)
+	old := c
+	old.Seq = 4
+	receive(t, l, b, old)
+	for _, dst := range []string{"b", "c", "d"} {
+		if routes := tr.take(dst); len(routes) != 0 {
+			t.Errorf("known route forwarded to %s: %+v", dst, routes)
+		}
+	}
+
+	// a route of a previous run of a is outdated
+	l.mesh.mu.Lock()
+	seq := l.mesh.self.Seq
+	l.mesh.mu.Unlock()
+	receive(t, l, b, wire.Route{Origin: "a", Seq: seq + 10})
+	routes := tr.take("d")
+	if len(routes) != 1 || routes[0].Origin != "a" || routes[0].Seq != seq+11 {
+		t.Errorf("announced %+v to d, want the own route with seq %d", routes, seq+11)
+	}
+
+	// routes of nodes that are no members are ignored
+	receive(t, l, b, wire.Route{Origin: "e", Seq: 1, Addresses: []string{"10.0.0.5"}})
+	if l.peerByAddress("e") != nil {
+		t.Error("route of a node that is no member learned")
+	}
+}
+
+func TestMeshWithdrawal(t *testing.T) {
+	l, tr := newTestMesh(t)
+	b := l.peerByAddress("b")
+	receive(t, l, b, wire.Route{Origin: "c", Seq: 5, Addresses: []string{"10.0.0.3"}})
+	tr.take("d")
+
+	receive(t, l, b, wire.Route{Origin: "c", Seq: 6, Withdrawn: true})
+	if l.peerByAddress("c") != nil {
+		t.Error("withdrawn node c not removed")
+	}
+	if l.table.Lookup(net.ParseIP("10.0.0.3")) != nil {
+		t.Error("route of withdrawn node c not removed")
+	}
+	if routes := tr.take("d"); len(routes) != 1 || !routes[0].Withdrawn {
+		t.Errorf("announced %+v to d, want the withdrawal of c", routes)
+	}
+
+	// an older announcement does not bring the node back
+	receive(t, l, b, wire.Route{Origin: "c", Seq: 5, Addresses: []string{"10.0.0.3"}})
+	if l.peerByAddress("c") != nil {
+		t.Error("node c learned again from an older announcement")
+	}
+}
+
+func TestMeshExpiry(t *testing.T) {
+	l, _ := newTestMesh(t)
+	receive(t, l, l.peerByAddress("b"), wire.Route{Origin: "c", Seq: 5, Addresses: []string{"10.0.0.3"}})
+
+	now := time.Now()
+	l.expireRoutes(now)
+	if l.peerByAddress("c") == nil {
+		t.Fatal("route of c expired early")
+	}
+
+	// a route not announced within the expiry is withdrawn
+	now = now.Add(l.mesh.expiry + time.Second)
+	l.expireRoutes(now)
+	if l.peerByAddress("c") != nil || l.table.Lookup(net.ParseIP("10.0.0.3")) != nil {
+		t.Error("expired route of c not removed")
+	}
+	withdrawn := false
+	for _, r := range l.meshRoutes() {
+		withdrawn = withdrawn || (r.Origin == "c" && r.Withdrawn)
+	}
+	if !withdrawn {
+		t.Error("expired route of c not announced as withdrawn")
+	}
+
+	// and dropped after another expiry
+	l.expireRoutes(now.Add(l.mesh.expiry + time.Second))
+	if routes := l.meshRoutes(); len(routes) != 1 {
+		t.Errorf("routes %+v left, want only the own one", routes)
+	}
+}
@@ -0,0 +1,315 @@
+//go:build linux
+
+package link
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+
+	"github.com/omani/nkn-link/config"
+	"github.com/omani/nkn-link/wire"
+	"github.com/vishvananda/netlink"
+)
+
+// setup creates the TUN device and applies the network configuration.
+func (l *Link) setup() error {
+	l.mode = l.conf.GetMode()
+	switch l.mode {
+	case config.ModePeer, config.ModeServer, config.ModeClient, config.ModeMesh:
+	default:
+		return fmt.Errorf("unknown mode %q", l.mode)
+	}
+	switch l.conf.GetDefaultRouteMode() {
+	case config.DefaultRouteModeMetric, config.DefaultRouteModePolicy:
+	default:
+		return fmt.Errorf("unknown default_route_mode %q", l.conf.DefaultRouteMode)
+	}
+
+	peers, err := newPeers(l.conf.GetPeers())
+	if err != nil {
+		return err
+	}
+	if len(peers) == 0 && l.mode != config.ModeServer && l.mode != config.ModeMesh {
+		return errors.New("no peers configured")
+	}
+	if len(peers) != 1 && l.mode == config.ModeClient {
+		return errors.New("client mode needs exactly one peer, the server")
+	}
+	l.table = newAllowedIPs()
+	l.byKey = make(map[string]*peer, len(peers))
+	for _, p := range peers {
+		l.addPeer(p)
+	}
+
+	mtu := l.conf.GetMTU()
+	if mtu < minMTU || mtu > maxMTU {
+		return fmt.Errorf("mtu %d out of range [%d, %d]", mtu, minMTU, maxMTU)
+	}
+	l.setMTU(mtu)
+	l.maxMessageSize = l.conf.GetMaxMessageSize()
+	if l.maxMessageSize <= wire.HeaderLen+wire.FragmentHeaderLen {
+		return fmt.Errorf("max_message_size %d too small", l.maxMessageSize)
+	}
+	if l.conf.GetKeepaliveTimeout() <= l.conf.GetKeepaliveInterval() {
+		return fmt.Errorf("keepalive_timeout_ms must be larger than keepalive_interval_ms")
+	}
+	l.reassembler = newReassembler(l.conf.GetFragmentTimeout(), l.conf.GetFragmentMemoryLimit(), &l.counters)
+
+	// validate addresses before touching the system. a client gets its
+	// addresses from the server.
+	if l.mode == config.ModeClient && len(l.conf.TunDeviceIPAddress) > 0 {
+		log.Println("Ignoring `tun_device_ip_address` in client mode, the server assigns the addresses.")
+	}
+	for _, a := range l.conf.TunDeviceIPAddress {
+		if l.mode == config.ModeClient {
+			break
+		}
+		addr, err := parseAddress(a)
+		if err != nil {
+			return fmt.Errorf("tun_device_ip_address: %w", err)
+		}
+		l.addrs = append(l.addrs, addr)
+	}
+
+	for _, cidr := range l.conf.AdvertisedSubnets {
+		_, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("advertised_subnets: %w", err)
+		}
+	}
+	l.includes, err = parsePrefixes("route_include", l.conf.RouteInclude)
+	if err != nil {
+		return err
+	}
+	l.excludes, err = parsePrefixes("route_exclude", l.conf.RouteExclude)
+	if err != nil {
+		return err
+	}
+	for _, s := range l.conf.TunnelUIDs {
+		uids, err := parseUIDRange(s)
+		if err != nil {
+			return fmt.Errorf("tunnel_uids: %w", err)
+		}
+		l.uidRanges = append(l.uidRanges, uids)
+	}
+	for _, mark := range l.conf.TunnelFwmarks {
+		// a rule with mark 0 has no fwmark and matches all traffic
+		if mark <= 0 || int64(mark) > math.MaxUint32 {
+			return fmt.Errorf("tunnel_fwmarks: invalid mark %#x", mark)
+		}
+		if mark == l.conf.GetFwmark() {
+			return fmt.Errorf("tunnel_fwmarks: mark %#x is the fwmark of the NKN sockets", mark)
+		}
+	}
+	if (len(l.uidRanges) > 0 || len(l.conf.TunnelFwmarks) > 0) && l.conf.DefaultRouteEnable {
+		return errors.New("tunnel_uids and tunnel_fwmarks cannot be combined with default_route_enable")
+	}
+	l.codec, err = wire.ParseCodec(l.conf.Compression)
+	if err != nil {
+		return err
+	}
+	switch l.mode {
+	case config.ModeServer:
+		err = l.setupServer()
+	case config.ModeMesh:
+		err = l.setupMesh()
+	}
+	if err != nil {
+		return err
+	}
+
+	err = l.host.open(mtu)
+	if err != nil {
+		return err
+	}
+	return l.setupNetwork()
+}
+
+// setupNetwork assigns the addresses of the TUN device and changes the
+// routing table as configured.
+func (l *Link) setupNetwork() error {
+	// set IP addresses of new TUN device
+	for _, addr := range l.addresses() {
+		err := l.host.addAddr(addr)
+		if err != nil {
+			return fmt.Errorf("could not add address %s to %s: %w", formatAddress(addr), l.tunLink.Attrs().Name, err)
+		}
+	}
+
+	// the previous setting of forwarding is restored on close
+	if l.conf.EnableIPForwarding {
+		err := l.host.setSysctl("net.ipv4.ip_forward", "1")
+		if err != nil {
+			return err
+		}
+		if l.tunAddress(netlink.FAMILY_V6) != nil {
+			err = l.host.setSysctl("net.ipv6.conf.all.forwarding", "1")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := l.setupIncludedRoutes()
+	if err != nil {
+		return err
+	}
+
+	// a client changes the default route once it got its addresses
+	if l.mode == config.ModeClient {
+		return nil
+	}
+	return l.setupDefaultRoutes()
+}
+
+// setupDefaultRoutes changes the default route of every family a gateway is
+// configured for.
+func (l *Link) setupDefaultRoutes() error {
+	// if `gateway` is set, change routing table accordingly.
+	if l.conf.DefaultRouteEnable {
+		if len(l.conf.DefaultRouteGatewayAddress) == 0 {
+			log.Println("`default_route_gateway_address` not set in config.yaml. Skipping.")
+		}
+		for _, gateway := range l.conf.DefaultRouteGatewayAddress {
+			err := l.setupDefaultRoute(gateway)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return l.setupSelectedRoutes()
+}
+
+// setupDefaultRoute moves the current default route of the family of gateway
+// to a higher metric and adds a new default route through gateway. With
+// route_exclude, the excluded prefixes keep the current default route and
+// the rest of the address space is routed through gateway instead.
+func (l *Link) setupDefaultRoute(gateway string) error {
+	gw := net.ParseIP(gateway)
+	if gw == nil {
+		return fmt.Errorf("invalid `default_route_gateway_address` %q", gateway)
+	}
+	family := ipFamily(gw)
+	excludes := l.excluded(family)
+	dsts := excludePrefixes([]*net.IPNet{defaultDst(family)}, excludes)
+
+	if l.conf.GetDefaultRouteMode() == config.DefaultRouteModePolicy {
+		return l.setupPolicyRoute(gw, dsts)
+	}
+
+	original, err := l.findDefaultRoute(family)
+	if err != nil {
+		return err
+	}
+
+	table := 0
+	if original != nil {
+		// the previous default route stays as it is if it only takes the
+		// excluded prefixes
+		fallback := *original
+		if len(excludes) == 0 {
+			err = l.host.removeRoute(original)
+			if err != nil {
+				return err
+			}
+			// lower its metric so our new default route is higher
+			fallback.Priority = fallbackPriority
+			err = l.host.addRoute(fallback)
+			if err != nil {
+				return err
+			}
+		}
+		table = original.Table
+
+		// keep the NKN nodes and seed RPC servers reachable
+		err = l.bypassRoutes.setFallback(family, fallback)
+		if err != nil {
+			return err
+		}
+	}
+
+	// now add a new default route with our remote peer as the gateway
+	for _, dst := range dsts {
+		err = l.host.addRoute(netlink.Route{
+			LinkIndex: l.tunLink.Attrs().Index,
+			Dst:       dst,
+			Src:       l.tunAddress(family),
+			Priority:  0,
+			Table:     table,
+			Gw:        gw,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findDefaultRoute returns the default route of the given family in the main
+// routing table, or nil if there is none.
+func (l *Link) findDefaultRoute(family int) (*netlink.Route, error) {
+	routelist, err := l.host.routes(family)
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range routelist {
+		if route.Dst == nil || isDefaultDst(route.Dst) {
+			route := route
+			return &route, nil
+		}
+	}
+	return nil, nil
+}
+
+// tunAddress returns the first address of the TUN device of the given
+// family, or nil.
+func (l *Link) tunAddress(family int) net.IP {
+	for _, addr := range l.addresses() {
+		if ipFamily(addr.IP) == family {
+			return addr.IP
+		}
+	}
+	return nil
+}
+
+// cleanup rolls back the changes setup made to the host.
+func (l *Link) cleanup() error {
+	return l.host.close()
+}
+
+// fallbackPriority is the metric previous default routes are moved to.
+const fallbackPriority = 100
+
+// ipFamily returns the netlink address family of ip.
+func ipFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+// defaultDst returns the destination of a default route of the given family.
+func defaultDst(family int) *net.IPNet {
+	if family == netlink.FAMILY_V4 {
+		return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+	}
+	return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+}
+
+// isDefaultDst reports whether dst is 0.0.0.0/0 or ::/0.
+func isDefaultDst(dst *net.IPNet) bool {
+	ones, _ := dst.Mask.Size()
+	return ones == 0
+}
+
+// hostDst returns the destination of a host route to ip.
+func hostDst(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
@@ -0,0 +1,75 @@
+//go:build linux
+
+package link
+
+import (
+	"net"
+)
+
+// bounds of the MTU of the TUN device
+const (
+	minMTU = 68
+	maxMTU = 65535
+)
+
+const (
+	ipv4HeaderLen = 20 // minimum length of an IPv4 header
+	ipv6HeaderLen = 40 // length of the fixed IPv6 header
+)
+
+// destination returns the destination address of an IPv4 or IPv6 packet, or
+// nil if packet is not a valid IP packet.
+func destination(packet []byte) net.IP {
+	if len(packet) == 0 {
+		return nil
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) >= ipv4HeaderLen {
+			return net.IP(packet[16:20])
+		}
+	case 6:
+		if len(packet) >= ipv6HeaderLen {
+			return net.IP(packet[24:40])
+		}
+	}
+	return nil
+}
+
+// source returns the source address of an IPv4 or IPv6 packet, or nil if
+// packet is not a valid IP packet.
+func source(packet []byte) net.IP {
+	if len(packet) == 0 {
+		return nil
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) >= ipv4HeaderLen {
+			return net.IP(packet[12:16])
+		}
+	case 6:
+		if len(packet) >= ipv6HeaderLen {
+			return net.IP(packet[8:24])
+		}
+	}
+	return nil
+}
+
+// protocol returns the protocol number of an IPv4 packet or the next header
+// of an IPv6 packet, or 0 if packet is not a valid IP packet.
+func protocol(packet []byte) byte {
+	if len(packet) == 0 {
+		return 0
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) >= ipv4HeaderLen {
+			return packet[9]
+		}
+	case 6:
+		if len(packet) >= ipv6HeaderLen {
+			return packet[6]
+		}
+	}
+	return 0
+}
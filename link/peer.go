@@ -0,0 +1,157 @@
+//go:build linux
+
+package link
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omani/nkn-link/config"
+	"github.com/omani/nkn-link/wire"
+	"github.com/vishvananda/netlink"
+)
+
+// peer is a remote nkn-link instance reachable over the transport. Its
+// allowed IPs are both the destinations routed to it and the only source
+// addresses accepted from it.
+type peer struct {
+	counters      peerCounters // first for 64-bit alignment of the atomic counters
+	versionWarned uint32       // set once messages of an unknown version were logged
+	ready         uint32       // set while the handshake with the peer is completed
+
+	address    string          // transport address of the peer
+	allowedIPs []*net.IPNet    // destinations routed to the peer
+	batcher    *batcher        // coalesces packets sent to the peer, nil if batching is disabled
+	codec      byte            // codec compressing messages sent to the peer
+	lease      []*net.IPNet    // addresses leased to the peer by the server
+	learned    []*net.IPNet    // prefixes learned from mesh announcements, guarded by the mesh
+	dynamic    bool            // whether the peer was added at runtime instead of configured
+	subnets    []netlink.Route // routes to the subnets advertised by the peer, guarded by the link
+
+	mu       sync.Mutex
+	state    PeerState
+	lastSeen time.Time     // when the last message was received from the peer
+	rtt      time.Duration // round-trip time measured by the last keepalive
+	mismatch string        // reason the last handshake failed, empty if none
+}
+
+// PeerState is the liveness of a peer as determined by keepalives.
+type PeerState int
+
+// peer states
+const (
+	PeerConnecting PeerState = iota // nothing received from the peer yet
+	PeerUp                          // the peer sent a message within the keepalive timeout
+	PeerDown                        // the peer has been silent for longer than the keepalive timeout
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerConnecting:
+		return "connecting"
+	case PeerUp:
+		return "up"
+	case PeerDown:
+		return "down"
+	default:
+		return fmt.Sprintf("PeerState(%d)", int(s))
+	}
+}
+
+// seen records that a message was received from the peer at now and returns
+// the previous state of the peer.
+func (p *peer) seen(now time.Time) PeerState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := p.state
+	p.state = PeerUp
+	p.lastSeen = now
+	return old
+}
+
+// expire marks the peer down if nothing was received from it since the
+// deadline and reports whether its state changed. since is used instead of
+// the time the peer was last seen if it has never been seen.
+func (p *peer) expire(deadline, since time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	last := p.lastSeen
+	if last.IsZero() {
+		last = since
+	}
+	if p.state == PeerDown || !last.Before(deadline) {
+		return false
+	}
+	p.state = PeerDown
+	return true
+}
+
+// isReady reports whether traffic may be exchanged with the peer.
+func (p *peer) isReady() bool {
+	return atomic.LoadUint32(&p.ready) == 1
+}
+
+// setReady enables or disables traffic with the peer and reports whether
+// this changed anything.
+func (p *peer) setReady(ready bool) bool {
+	if ready {
+		if !atomic.CompareAndSwapUint32(&p.ready, 0, 1) {
+			return false
+		}
+		p.mu.Lock()
+		p.mismatch = ""
+		p.mu.Unlock()
+		return true
+	}
+	return atomic.CompareAndSwapUint32(&p.ready, 1, 0)
+}
+
+// status returns the state of the peer, when it was last seen and its
+// round-trip time.
+func (p *peer) status() (PeerState, time.Time, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state, p.lastSeen, p.rtt
+}
+
+// publicKey returns the public key part of a NKN address. The identifier
+// prefix is ignored, so every client of a NKN account maps to the same key.
+func publicKey(addr string) string {
+	if i := strings.LastIndexByte(addr, '.'); i >= 0 {
+		addr = addr[i+1:]
+	}
+	return strings.ToLower(addr)
+}
+
+// newPeers creates the peers of the configuration.
+func newPeers(confs []config.PeerConfig) ([]*peer, error) {
+	peers := make([]*peer, 0, len(confs))
+
+	for _, c := range confs {
+		if len(c.Address) == 0 {
+			return nil, fmt.Errorf("peer without address in config")
+		}
+		codec, err := wire.ParseCodec(c.Compression)
+		if err != nil {
+			return nil, fmt.Errorf("peer %s: %w", c.Address, err)
+		}
+		p := &peer{
+			address: c.Address,
+			codec:   codec,
+		}
+		for _, cidr := range c.AllowedIPs {
+			_, prefix, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("peer %s: invalid allowed IP %q: %w", c.Address, cidr, err)
+			}
+			p.allowedIPs = append(p.allowedIPs, prefix)
+		}
+		peers = append(peers, p)
+	}
+
+	return peers, nil
+}
@@ -0,0 +1,165 @@
+//go:build linux
+
+package link
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// setupPolicyRoute adds routes to dsts through gateway to the routing table
+// of the tunnel and ip rules sending all traffic into it, except for the
+// marked sockets of NKN. Like wg-quick, it leaves the main table untouched.
+// Destinations missing from the table fall through to the main table.
+func (l *Link) setupPolicyRoute(gw net.IP, dsts []*net.IPNet) error {
+	family := ipFamily(gw)
+	table := l.conf.GetRouteTable()
+
+	for _, dst := range dsts {
+		err := l.host.addRoute(netlink.Route{
+			LinkIndex: l.tunLink.Attrs().Index,
+			Dst:       dst,
+			Src:       l.tunAddress(family),
+			Table:     table,
+			Gw:        gw,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// everything but the NKN sockets goes into the table of the tunnel
+	rule := netlink.NewRule()
+	rule.Family = family
+	rule.Table = table
+	rule.Mark = uint32(l.conf.GetFwmark())
+	rule.Invert = true
+	err := l.host.addRule(rule)
+	if err != nil {
+		return err
+	}
+	err = l.addSuppressRule(family)
+	if err != nil {
+		return err
+	}
+
+	// let replies to the marked sockets pass the reverse path filter
+	if family == netlink.FAMILY_V4 {
+		return l.host.setSysctl("net.ipv4.conf.all.src_valid_mark", "1")
+	}
+	return nil
+}
+
+// setupSelectedRoutes sends the traffic of the users of tunnel_uids and the
+// marks of tunnel_fwmarks into the routing table of the tunnel. The table
+// routes the address space, without route_exclude, through the TUN device.
+func (l *Link) setupSelectedRoutes() error {
+	if len(l.uidRanges) == 0 && len(l.conf.TunnelFwmarks) == 0 {
+		return nil
+	}
+	table := l.conf.GetRouteTable()
+
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		src := l.tunAddress(family)
+		if src == nil {
+			continue
+		}
+		gw := l.gateway(family)
+		for _, dst := range excludePrefixes([]*net.IPNet{defaultDst(family)}, l.excluded(family)) {
+			route := netlink.Route{
+				LinkIndex: l.tunLink.Attrs().Index,
+				Dst:       dst,
+				Src:       src,
+				Table:     table,
+				Gw:        gw,
+			}
+			if gw == nil {
+				route.Scope = netlink.SCOPE_LINK
+			}
+			err := l.host.addRoute(route)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, uids := range l.uidRanges {
+			rule := netlink.NewRule()
+			rule.Family = family
+			rule.Table = table
+			rule.UIDRange = uids
+			err := l.host.addRule(rule)
+			if err != nil {
+				return err
+			}
+		}
+		for _, mark := range l.conf.TunnelFwmarks {
+			rule := netlink.NewRule()
+			rule.Family = family
+			rule.Table = table
+			rule.Mark = uint32(mark)
+			err := l.host.addRule(rule)
+			if err != nil {
+				return err
+			}
+		}
+		err := l.addSuppressRule(family)
+		if err != nil {
+			return err
+		}
+
+		if family == netlink.FAMILY_V4 && len(l.conf.TunnelFwmarks) > 0 {
+			err = l.host.setSysctl("net.ipv4.conf.all.src_valid_mark", "1")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addSuppressRule lets the routes of the main table more specific than its
+// default route, like those of the local networks, win over the table of
+// the tunnel. Added last, the rule gets the lower priority number and is
+// looked at first.
+func (l *Link) addSuppressRule(family int) error {
+	rule := netlink.NewRule()
+	rule.Family = family
+	rule.Table = syscall.RT_TABLE_MAIN
+	rule.SuppressPrefixlen = 0
+	return l.host.addRule(rule)
+}
+
+// gateway returns the address of default_route_gateway_address of the given
+// family, or nil.
+func (l *Link) gateway(family int) net.IP {
+	for _, gateway := range l.conf.DefaultRouteGatewayAddress {
+		gw := net.ParseIP(gateway)
+		if gw != nil && ipFamily(gw) == family {
+			return gw
+		}
+	}
+	return nil
+}
+
+// parseUIDRange parses a uid range of tunnel_uids, a single uid or
+// "start-end".
+func parseUIDRange(s string) (*netlink.RuleUIDRange, error) {
+	first, last := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		first, last = s[:i], s[i+1:]
+	}
+	start, err := strconv.ParseUint(strings.TrimSpace(first), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid range %q", s)
+	}
+	end, err := strconv.ParseUint(strings.TrimSpace(last), 10, 32)
+	if err != nil || end < start {
+		return nil, fmt.Errorf("invalid uid range %q", s)
+	}
+	return netlink.NewRuleUIDRange(uint32(start), uint32(end)), nil
+}
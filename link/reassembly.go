@@ -0,0 +1,137 @@
+//go:build linux
+
+package link
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omani/nkn-link/wire"
+)
+
+type fragmentKey struct {
+	peer *peer
+	id   uint32
+}
+
+// partial is a message of which not all fragments have been received yet.
+type partial struct {
+	parts    [][]byte
+	received int
+	size     int
+	expires  time.Time
+}
+
+// reassembler collects fragments until their message is complete. Messages
+// not completed within the timeout are dropped, as are the oldest messages
+// when the fragments held exceed the memory limit.
+type reassembler struct {
+	timeout time.Duration
+	limit   int
+	stats   *counters
+
+	mu      sync.Mutex
+	used    int // bytes held by all pending fragments
+	pending map[fragmentKey]*partial
+}
+
+func newReassembler(timeout time.Duration, limit int, stats *counters) *reassembler {
+	return &reassembler{
+		timeout: timeout,
+		limit:   limit,
+		stats:   stats,
+		pending: make(map[fragmentKey]*partial),
+	}
+}
+
+// Add adds a fragment received from peer p and returns the reassembled
+// message once all of its fragments have been added.
+func (r *reassembler) Add(p *peer, h wire.FragmentHeader, data []byte) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.expire(now)
+
+	if len(data) > r.limit {
+		atomic.AddUint64(&r.stats.rxReassemblyDropped, 1)
+		return nil
+	}
+
+	key := fragmentKey{peer: p, id: h.ID}
+	m := r.pending[key]
+	if m == nil {
+		m = &partial{
+			parts:   make([][]byte, h.Count),
+			expires: now.Add(r.timeout),
+		}
+		r.pending[key] = m
+	}
+	if len(m.parts) != int(h.Count) {
+		// fragments of the same message disagree on their number
+		r.drop(key, m)
+		atomic.AddUint64(&r.stats.rxReassemblyDropped, 1)
+		return nil
+	}
+	if m.parts[h.Index] != nil {
+		return nil
+	}
+
+	for r.used+len(data) > r.limit {
+		r.evict()
+		if r.pending[key] == nil {
+			// our own message was the oldest one
+			return nil
+		}
+	}
+
+	part := make([]byte, len(data))
+	copy(part, data)
+	m.parts[h.Index] = part
+	m.received++
+	m.size += len(part)
+	r.used += len(part)
+
+	if m.received < len(m.parts) {
+		return nil
+	}
+
+	msg := make([]byte, 0, m.size)
+	for _, part := range m.parts {
+		msg = append(msg, part...)
+	}
+	r.drop(key, m)
+	atomic.AddUint64(&r.stats.rxReassembled, 1)
+	return msg
+}
+
+// expire drops all messages whose timeout has passed.
+func (r *reassembler) expire(now time.Time) {
+	for key, m := range r.pending {
+		if now.After(m.expires) {
+			r.drop(key, m)
+			atomic.AddUint64(&r.stats.rxReassemblyTimeouts, 1)
+		}
+	}
+}
+
+// evict drops the message that expires first.
+func (r *reassembler) evict() {
+	var oldest *partial
+	var oldestKey fragmentKey
+	for key, m := range r.pending {
+		if oldest == nil || m.expires.Before(oldest.expires) {
+			oldest, oldestKey = m, key
+		}
+	}
+	if oldest != nil {
+		r.drop(oldestKey, oldest)
+		atomic.AddUint64(&r.stats.rxReassemblyDropped, 1)
+	}
+}
+
+func (r *reassembler) drop(key fragmentKey, m *partial) {
+	r.used -= m.size
+	delete(r.pending, key)
+}
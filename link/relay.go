@@ -0,0 +1,51 @@
+//go:build linux
+
+package link
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/omani/nkn-link/wire"
+)
+
+// relay forwards a packet received from client p to the client its
+// destination is routed to, without writing it to the TUN device. It reports
+// whether the packet was addressed to another client and thus handled.
+func (l *Link) relay(p *peer, packet []byte) bool {
+	if l.pool == nil || p.lease == nil {
+		return false
+	}
+	dst := destination(packet)
+	if dst == nil {
+		return false
+	}
+	q := l.table.Lookup(dst)
+	if q == nil || q == p || q.lease == nil {
+		return false
+	}
+
+	if !l.conf.ClientToClient {
+		atomic.AddUint64(&l.counters.relayDenied, 1)
+		if l.Debug {
+			log.Printf("Client-to-client traffic from %s to %s denied. Dropping packet.\n", p.address, q.address)
+		}
+		return true
+	}
+	if !q.isReady() {
+		atomic.AddUint64(&l.counters.txNotReady, 1)
+		return true
+	}
+
+	if q.batcher != nil && len(packet) <= wire.MaxBatchedPacket {
+		q.batcher.Add(packet)
+	} else {
+		msg := make([]byte, wire.HeaderLen+len(packet))
+		wire.PutHeader(msg, wire.TypePacket)
+		copy(msg[wire.HeaderLen:], packet)
+		l.send(q, msg)
+	}
+	atomic.AddUint64(&l.counters.relayed, 1)
+	atomic.AddUint64(&q.counters.txPackets, 1)
+	return true
+}
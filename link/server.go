@@ -0,0 +1,166 @@
+//go:build linux
+
+package link
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/omani/nkn-link/config"
+	"github.com/omani/nkn-link/lease"
+	"github.com/omani/nkn-link/wire"
+	"github.com/vishvananda/netlink"
+)
+
+// setupServer creates the address pool of a server. Without configured
+// addresses, the server takes the first address of every prefix of the pool.
+func (l *Link) setupServer() error {
+	if len(l.conf.AddressPool) == 0 {
+		return errors.New("server mode needs an `address_pool`")
+	}
+
+	var prefixes []*net.IPNet
+	for _, cidr := range l.conf.AddressPool {
+		_, prefix, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("address_pool: %w", err)
+		}
+		prefixes = append(prefixes, prefix)
+		if len(l.conf.TunDeviceIPAddress) == 0 {
+			l.addrs = append(l.addrs, &netlink.Addr{IPNet: firstHost(prefix)})
+		}
+	}
+
+	var reserved []net.IP
+	for _, addr := range l.addrs {
+		reserved = append(reserved, addr.IP)
+	}
+
+	var err error
+	l.profile, err = newProfile(l.conf.ClientProfile, l.getMTU())
+	if err != nil {
+		return fmt.Errorf("client_profile: %w", err)
+	}
+
+	l.pool, err = lease.NewPool(prefixes, reserved, l.conf.GetLeaseFile())
+	return err
+}
+
+// newProfile validates the client profile of the configuration. Clients get
+// the mtu of the server.
+func newProfile(conf config.ClientProfile, mtu int) (*wire.Profile, error) {
+	for _, cidr := range conf.Routes {
+		_, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, dns := range conf.DNS {
+		if net.ParseIP(dns) == nil {
+			return nil, fmt.Errorf("invalid DNS server %q", dns)
+		}
+	}
+	return &wire.Profile{
+		MTU:          mtu,
+		Routes:       conf.Routes,
+		DNS:          conf.DNS,
+		DefaultRoute: conf.DefaultRoute,
+	}, nil
+}
+
+// accept registers an unknown sender as new client of a server or as new
+// node of a mesh. It returns nil if the sender is not accepted.
+func (l *Link) accept(src string, msg []byte) *peer {
+	switch {
+	case l.pool != nil:
+		return l.acceptClient(src, msg)
+	case l.mesh != nil:
+		return l.acceptNode(src, msg)
+	}
+	return nil
+}
+
+// acceptClient registers the sender of a handshake as a new client of the
+// server and leases addresses to it. It returns nil if the sender is not
+// accepted.
+func (l *Link) acceptClient(src string, msg []byte) *peer {
+	typ, err := wire.Type(msg)
+	if err != nil || typ != wire.TypeHandshake || !l.clientAllowed(src) {
+		return nil
+	}
+
+	addrs, err := l.pool.Lease(publicKey(src))
+	if err != nil {
+		log.Printf("Could not lease addresses to client %s: %v\n", src, err)
+		return nil
+	}
+
+	p := &peer{
+		address: src,
+		codec:   l.codec,
+		lease:   addrs,
+		dynamic: true,
+	}
+	var leased []string
+	for _, addr := range addrs {
+		p.allowedIPs = append(p.allowedIPs, hostDst(addr.IP))
+		leased = append(leased, addr.String())
+	}
+	l.addPeer(p)
+
+	log.Printf("Client %s connected, leased %s.\n", src, strings.Join(leased, ", "))
+	return p
+}
+
+// clientAllowed reports whether the client sending from addr may connect.
+// Without `allowed_clients`, every client is allowed.
+func (l *Link) clientAllowed(addr string) bool {
+	if len(l.conf.AllowedClients) == 0 {
+		return true
+	}
+	key := publicKey(addr)
+	for _, client := range l.conf.AllowedClients {
+		if publicKey(client) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// firstHost returns the first host address of prefix with the length of
+// prefix.
+func firstHost(prefix *net.IPNet) *net.IPNet {
+	ip := make(net.IP, len(prefix.IP))
+	copy(ip, prefix.IP.Mask(prefix.Mask))
+	ip[len(ip)-1]++
+	return &net.IPNet{IP: ip, Mask: prefix.Mask}
+}
+
+// expireClients removes the clients that are down and extends the leases of
+// the others. Leases of clients not seen for the lease time expire.
+func (l *Link) expireClients(now time.Time) {
+	for _, p := range l.peerList() {
+		if p.lease == nil {
+			continue
+		}
+		state, _, _ := p.status()
+		if state == PeerDown {
+			l.removePeer(p)
+			log.Printf("Client %s removed.\n", p.address)
+			continue
+		}
+		l.pool.Touch(publicKey(p.address), now)
+	}
+
+	expired, err := l.pool.Expire(now.Add(-l.conf.GetLeaseTime()))
+	if err != nil {
+		log.Printf("Could not save leases: %v\n", err)
+	}
+	for _, key := range expired {
+		log.Printf("Lease of client %s expired.\n", key)
+	}
+}
@@ -0,0 +1,122 @@
+//go:build linux
+
+package link
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// parsePrefixes parses the CIDRs of the config option name.
+func parsePrefixes(name string, cidrs []string) ([]*net.IPNet, error) {
+	prefixes := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, prefix, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// excluded returns the prefixes of route_exclude of the given family.
+func (l *Link) excluded(family int) []*net.IPNet {
+	var prefixes []*net.IPNet
+	for _, prefix := range l.excludes {
+		if ipFamily(prefix.IP) == family {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// setupIncludedRoutes routes the prefixes of route_include, without those of
+// route_exclude, through the TUN device.
+func (l *Link) setupIncludedRoutes() error {
+	for _, dst := range excludePrefixes(l.includes, l.excludes) {
+		err := l.host.addRoute(netlink.Route{
+			LinkIndex: l.tunLink.Attrs().Index,
+			Dst:       dst,
+			Scope:     netlink.SCOPE_LINK,
+		})
+		if err != nil {
+			return fmt.Errorf("route_include %s: %w", dst, err)
+		}
+	}
+	return nil
+}
+
+// excludePrefixes returns the parts of prefixes not covered by any of
+// excludes. Prefixes covered by other prefixes are dropped.
+func excludePrefixes(prefixes, excludes []*net.IPNet) []*net.IPNet {
+	for _, q := range excludes {
+		var rest []*net.IPNet
+		for _, p := range prefixes {
+			rest = append(rest, subtractPrefix(p, q)...)
+		}
+		prefixes = rest
+	}
+
+	var out []*net.IPNet
+	for i, p := range prefixes {
+		covered := false
+		for j, q := range prefixes {
+			if i != j && coversPrefix(q, p) && (!coversPrefix(p, q) || j < i) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// subtractPrefix returns the parts of p not covered by q, as the fewest
+// prefixes possible.
+func subtractPrefix(p, q *net.IPNet) []*net.IPNet {
+	if coversPrefix(q, p) {
+		return nil
+	}
+	if !coversPrefix(p, q) {
+		return []*net.IPNet{p}
+	}
+
+	// halve p until q is reached, keeping the halves without q whole
+	var out []*net.IPNet
+	ones, bits := p.Mask.Size()
+	qOnes, _ := q.Mask.Size()
+	ip := p.IP
+	for ; ones < qOnes; ones++ {
+		mask := net.CIDRMask(ones+1, bits)
+		lower := &net.IPNet{IP: ip, Mask: mask}
+		upper := &net.IPNet{IP: setBit(ip, ones), Mask: mask}
+		if lower.Contains(q.IP) {
+			out = append(out, upper)
+		} else {
+			out = append(out, lower)
+			ip = upper.IP
+		}
+	}
+	return out
+}
+
+// coversPrefix reports whether p contains all addresses of q.
+func coversPrefix(p, q *net.IPNet) bool {
+	pOnes, pBits := p.Mask.Size()
+	qOnes, qBits := q.Mask.Size()
+	return pBits == qBits && pOnes <= qOnes && p.Contains(q.IP)
+}
+
+// setBit returns a copy of ip with bit i, counted from the most significant
+// one, set.
+func setBit(ip net.IP, i int) net.IP {
+	out := make(net.IP, len(ip))
+	copy(out, ip)
+	out[i/8] |= 0x80 >> (i % 8)
+	return out
+}
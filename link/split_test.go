@@ -0,0 +1,148 @@
+//go:build linux
+
+package link
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func parseNets(t *testing.T, cidrs string) []*net.IPNet {
+	t.Helper()
+	var nets []*net.IPNet
+	for _, cidr := range strings.Fields(cidrs) {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func formatNets(nets []*net.IPNet) string {
+	var s []string
+	for _, n := range nets {
+		s = append(s, n.String())
+	}
+	sort.Strings(s)
+	return strings.Join(s, " ")
+}
+
+func TestExcludePrefixes(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes string
+		excludes string
+		want     string
+	}{
+		{
+			name:     "host from default",
+			prefixes: "0.0.0.0/0",
+			excludes: "255.255.255.255/32",
+			want: "0.0.0.0/1 128.0.0.0/2 192.0.0.0/3 224.0.0.0/4 240.0.0.0/5 248.0.0.0/6 252.0.0.0/7 254.0.0.0/8 " +
+				"255.0.0.0/9 255.128.0.0/10 255.192.0.0/11 255.224.0.0/12 255.240.0.0/13 255.248.0.0/14 255.252.0.0/15 " +
+				"255.254.0.0/16 255.255.0.0/17 255.255.128.0/18 255.255.192.0/19 255.255.224.0/20 255.255.240.0/21 " +
+				"255.255.248.0/22 255.255.252.0/23 255.255.254.0/24 255.255.255.0/25 255.255.255.128/26 " +
+				"255.255.255.192/27 255.255.255.224/28 255.255.255.240/29 255.255.255.248/30 255.255.255.252/31 " +
+				"255.255.255.254/32",
+		},
+		{
+			name:     "disjoint",
+			prefixes: "10.0.0.0/8",
+			excludes: "192.168.0.0/16 172.16.0.0/12",
+			want:     "10.0.0.0/8",
+		},
+		{
+			name:     "two halves",
+			prefixes: "10.0.0.0/8",
+			excludes: "10.0.0.0/9 10.192.0.0/10",
+			want:     "10.128.0.0/10",
+		},
+		{
+			name:     "nested",
+			prefixes: "10.0.0.0/8",
+			excludes: "10.1.0.0/16 10.1.2.0/24",
+			want:     "10.0.0.0/16 10.2.0.0/15 10.4.0.0/14 10.8.0.0/13 10.16.0.0/12 10.32.0.0/11 10.64.0.0/10 10.128.0.0/9",
+		},
+		{
+			name:     "whole prefix",
+			prefixes: "10.0.0.0/8",
+			excludes: "10.0.0.0/8",
+			want:     "",
+		},
+		{
+			name:     "larger than the prefix",
+			prefixes: "10.1.0.0/16 192.168.0.0/24",
+			excludes: "10.0.0.0/8",
+			want:     "192.168.0.0/24",
+		},
+		{
+			name:     "covered prefixes dropped",
+			prefixes: "10.0.0.0/8 10.1.0.0/16 10.0.0.0/8",
+			excludes: "",
+			want:     "10.0.0.0/8",
+		},
+		{
+			name:     "ipv6",
+			prefixes: "::/0 2001:db8::/30",
+			excludes: "8000::/1 2001:db9::/32",
+			want:     "::/3 2000::/16 2001::/21 2001:800::/22 2001:c00::/24 2001:d00::/25 2001:d80::/27 2001:da0::/28 " +
+				"2001:db0::/29 2001:db8::/32 2001:dba::/31 2001:dbc::/30 2001:dc0::/26 2001:e00::/23 2001:1000::/20 " +
+				"2001:2000::/19 2001:4000::/18 2001:8000::/17 2002::/15 2004::/14 2008::/13 2010::/12 2020::/11 " +
+				"2040::/10 2080::/9 2100::/8 2200::/7 2400::/6 2800::/5 3000::/4 4000::/2",
+		},
+		{
+			name:     "ipv6 host",
+			prefixes: "2001:db8::/126",
+			excludes: "2001:db8::2/128",
+			want:     "2001:db8::/127 2001:db8::3/128",
+		},
+		{
+			name:     "other family untouched",
+			prefixes: "0.0.0.0/0 ::/0",
+			excludes: "0.0.0.0/1",
+			want:     "128.0.0.0/1 ::/0",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := excludePrefixes(parseNets(t, test.prefixes), parseNets(t, test.excludes))
+			want := formatNets(parseNets(t, test.want))
+			if formatNets(got) != want {
+				t.Errorf("got %s, want %s", formatNets(got), want)
+			}
+			// no excluded address is left
+			for _, p := range got {
+				for _, q := range parseNets(t, test.excludes) {
+					if p.Contains(q.IP) || q.Contains(p.IP) {
+						t.Errorf("%s overlaps the exclusion %s", p, q)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSubtractPrefix(t *testing.T) {
+	p := parseNets(t, "0.0.0.0/0")[0]
+	got := subtractPrefix(p, parseNets(t, "1.2.3.4/32")[0])
+	if len(got) != 32 {
+		t.Errorf("0.0.0.0/0 without a /32 split into %d prefixes, want 32", len(got))
+	}
+	// the parts plus the removed address cover the whole address space
+	size := uint64(1)
+	for _, n := range got {
+		ones, _ := n.Mask.Size()
+		size += 1 << (32 - ones)
+	}
+	if size != 1<<32 {
+		t.Errorf("parts cover %d addresses, want %d", size, uint64(1)<<32)
+	}
+
+	if got := subtractPrefix(p, p); len(got) != 0 {
+		t.Errorf("prefix without itself is %s, want nothing", formatNets(got))
+	}
+}
@@ -0,0 +1,116 @@
+//go:build linux
+
+package link
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds the packet counters of a link.
+type Stats struct {
+	TxPackets  uint64 // packets sent to peers
+	RxPackets  uint64 // packets written to the TUN device
+	TxMessages uint64 // messages sent to peers, a message may carry a batch of packets
+	RxMessages uint64 // messages received from peers
+
+	TxCompressed uint64 // messages sent with a compressed payload
+
+	TxFragments          uint64 // fragments sent for messages exceeding the maximum message size
+	RxFragments          uint64 // fragments received
+	RxReassembled        uint64 // messages reassembled from fragments
+	RxReassemblyTimeouts uint64 // messages dropped because not all fragments arrived in time
+	RxReassemblyDropped  uint64 // messages dropped because of invalid fragments or the memory limit
+
+	TxNoPeer         uint64 // outgoing packets dropped because no peer matched their destination
+	TxNotReady       uint64 // outgoing packets dropped because the handshake with their peer is not completed
+	RxNotReady       uint64 // incoming messages dropped because the handshake with their sender is not completed
+	RxUnknownSender  uint64 // incoming messages dropped because the sender is not a configured peer
+	RxInvalid        uint64 // incoming messages dropped because they are malformed or no IP packet
+	RxUnknownVersion uint64 // incoming messages dropped because of an unknown wire format version
+	RxSpoofed        uint64 // incoming packets dropped because of a source address not allowed for their peer
+
+	Relayed     uint64 // packets relayed from one client of the server to another
+	RelayDenied uint64 // packets between clients dropped because client-to-client traffic is denied
+}
+
+// PeerStats holds the packet counters and the liveness of a single peer.
+type PeerStats struct {
+	Address   string        // transport address of the peer
+	State     PeerState     // liveness of the peer
+	Ready     bool          // whether the handshake with the peer is completed
+	LastSeen  time.Time     // when the last message was received from the peer, zero if never
+	RTT       time.Duration // round-trip time measured by the last keepalive, zero if unknown
+	TxPackets uint64        // packets sent to the peer
+	RxPackets uint64        // packets received from the peer and written to the TUN device
+	RxSpoofed uint64        // packets received from the peer with a source address not allowed for it
+}
+
+// counters are the live counters behind Stats, updated atomically.
+type counters struct {
+	txPackets    uint64
+	rxPackets    uint64
+	txMessages   uint64
+	rxMessages   uint64
+	txCompressed uint64
+
+	txFragments          uint64
+	rxFragments          uint64
+	rxReassembled        uint64
+	rxReassemblyTimeouts uint64
+	rxReassemblyDropped  uint64
+
+	txNoPeer         uint64
+	txNotReady       uint64
+	rxNotReady       uint64
+	rxUnknownSender  uint64
+	rxInvalid        uint64
+	rxUnknownVersion uint64
+	rxSpoofed        uint64
+
+	relayed     uint64
+	relayDenied uint64
+}
+
+func (c *counters) stats() Stats {
+	return Stats{
+		TxPackets:    atomic.LoadUint64(&c.txPackets),
+		RxPackets:    atomic.LoadUint64(&c.rxPackets),
+		TxMessages:   atomic.LoadUint64(&c.txMessages),
+		RxMessages:   atomic.LoadUint64(&c.rxMessages),
+		TxCompressed: atomic.LoadUint64(&c.txCompressed),
+
+		TxFragments:          atomic.LoadUint64(&c.txFragments),
+		RxFragments:          atomic.LoadUint64(&c.rxFragments),
+		RxReassembled:        atomic.LoadUint64(&c.rxReassembled),
+		RxReassemblyTimeouts: atomic.LoadUint64(&c.rxReassemblyTimeouts),
+		RxReassemblyDropped:  atomic.LoadUint64(&c.rxReassemblyDropped),
+
+		TxNoPeer:         atomic.LoadUint64(&c.txNoPeer),
+		TxNotReady:       atomic.LoadUint64(&c.txNotReady),
+		RxNotReady:       atomic.LoadUint64(&c.rxNotReady),
+		RxUnknownSender:  atomic.LoadUint64(&c.rxUnknownSender),
+		RxInvalid:        atomic.LoadUint64(&c.rxInvalid),
+		RxUnknownVersion: atomic.LoadUint64(&c.rxUnknownVersion),
+		RxSpoofed:        atomic.LoadUint64(&c.rxSpoofed),
+
+		Relayed:     atomic.LoadUint64(&c.relayed),
+		RelayDenied: atomic.LoadUint64(&c.relayDenied),
+	}
+}
+
+// peerCounters are the live counters behind PeerStats, updated atomically.
+type peerCounters struct {
+	txPackets uint64
+	rxPackets uint64
+	rxSpoofed uint64
+}
+
+func (c *peerCounters) stats(address string) PeerStats {
+	return PeerStats{
+		Address:   address,
+		TxPackets: atomic.LoadUint64(&c.txPackets),
+		RxPackets: atomic.LoadUint64(&c.rxPackets),
+		RxSpoofed: atomic.LoadUint64(&c.rxSpoofed),
+	}
+}
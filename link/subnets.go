@@ -0,0 +1,127 @@
+//go:build linux
+
+package link
+
+import (
+	"log"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// installSubnets routes the subnets advertised by peer p through the TUN
+// device, replacing the routes installed for it before. Subnets not covered
+// by one of the allowed IPs of the peer, routed to another peer or
+// overlapping a route of the host outside the tunnel are skipped.
+func (l *Link) installSubnets(p *peer, subnets []string) {
+	var dsts []*net.IPNet
+	for _, cidr := range subnets {
+		_, dst, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Printf("Peer %s advertises invalid subnet %q. Skipping.\n", p.address, cidr)
+			continue
+		}
+		if ones, _ := dst.Mask.Size(); ones == 0 {
+			log.Printf("Peer %s advertises the default route %s. Skipping.\n", p.address, dst)
+			continue
+		}
+		if !l.allowedFor(p, dst) || l.table.Lookup(dst.IP) != p {
+			log.Printf("Subnet %s advertised by peer %s is not in its allowed_ips. Skipping.\n", dst, p.address)
+			continue
+		}
+		route, err := l.hostRoute(dst)
+		if err != nil {
+			log.Printf("Could not check subnet %s of peer %s against the routes of the host: %v\n", dst, p.address, err)
+			continue
+		}
+		if route != nil {
+			log.Printf("Subnet %s advertised by peer %s overlaps the route to %s of the host. Skipping.\n", dst, p.address, route.Dst)
+			continue
+		}
+		dsts = append(dsts, dst)
+	}
+
+	l.mu.Lock()
+	same := len(dsts) == len(p.subnets)
+	for i := 0; same && i < len(dsts); i++ {
+		same = dsts[i].String() == p.subnets[i].Dst.String()
+	}
+	l.mu.Unlock()
+	if same {
+		return
+	}
+
+	l.removeSubnets(p)
+	for _, dst := range dsts {
+		route := netlink.Route{
+			LinkIndex: l.tunLink.Attrs().Index,
+			Dst:       dst,
+			Scope:     netlink.SCOPE_LINK,
+		}
+		err := l.host.addRoute(route)
+		if err != nil {
+			log.Printf("Could not add route to subnet %s of peer %s: %v\n", dst, p.address, err)
+			continue
+		}
+		l.mu.Lock()
+		p.subnets = append(p.subnets, route)
+		l.mu.Unlock()
+		log.Printf("Added route to subnet %s of peer %s.\n", dst, p.address)
+	}
+}
+
+// allowedFor reports whether one of the allowed IPs of peer p, configured
+// or learned from the mesh, covers dst. The allowed IPs of `nkn_remote_peer`
+// default to everything, so they only count with `accept_subnets`.
+func (l *Link) allowedFor(p *peer, dst *net.IPNet) bool {
+	if len(l.conf.Peers) > 0 || l.conf.AcceptSubnets {
+		for _, prefix := range p.allowedIPs {
+			if coversPrefix(prefix, dst) {
+				return true
+			}
+		}
+	}
+	if l.mesh == nil {
+		return false
+	}
+	l.mesh.mu.Lock()
+	defer l.mesh.mu.Unlock()
+	for _, prefix := range p.learned {
+		if coversPrefix(prefix, dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeSubnets removes the routes to the subnets advertised by peer p.
+func (l *Link) removeSubnets(p *peer) {
+	l.mu.Lock()
+	routes := p.subnets
+	p.subnets = nil
+	l.mu.Unlock()
+
+	for i := range routes {
+		l.host.delRoute(routes[i])
+		log.Printf("Removed route to subnet %s of peer %s.\n", routes[i].Dst, p.address)
+	}
+}
+
+// hostRoute returns a route of the host outside the tunnel that overlaps
+// dst, or nil. Default routes do not count.
+func (l *Link) hostRoute(dst *net.IPNet) (*netlink.Route, error) {
+	routes, err := l.host.routes(ipFamily(dst.IP))
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range routes {
+		if route.Dst == nil || isDefaultDst(route.Dst) || route.LinkIndex == l.tunLink.Attrs().Index {
+			continue
+		}
+		if route.Dst.Contains(dst.IP) || dst.Contains(route.Dst.IP) {
+			route := route
+			return &route, nil
+		}
+	}
+	return nil, nil
+}
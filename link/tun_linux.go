@@ -0,0 +1,10 @@
+package link
+
+import (
+	"github.com/omani/nkn-link/tun"
+)
+
+// createTUN creates the TUN device, optionally without packet information.
+func createTUN(name string, mtu int, nopi bool) (tun.Device, error) {
+	return tun.CreateTUNWithOptions(name, mtu, nopi)
+}
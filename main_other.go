@@ -0,0 +1,14 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+func main() {
+	fmt.Fprintf(os.Stderr, "nkn-link does not support %s, only linux.\n", runtime.GOOS)
+	os.Exit(1)
+}
@@ -0,0 +1,37 @@
+package transport
+
+import (
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+)
+
+// MarkSockets sets the fwmark mark on every socket the NKN SDK dials from now
+// on: the websocket connections to the NKN nodes and the RPC requests. Policy
+// routing uses the mark to keep them out of the tunnel.
+//
+// The SDK offers no dialer of its own, so MarkSockets changes the process-wide
+// websocket.DefaultDialer and http.DefaultTransport. Every other connection
+// dialed through them is marked too and bypasses the tunnel.
+func MarkSockets(mark int) error {
+	dialer := &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			cerr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+			})
+			if cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+
+	websocket.DefaultDialer.NetDialContext = dialer.DialContext
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		t.DialContext = dialer.DialContext
+	}
+	return nil
+}
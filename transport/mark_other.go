@@ -0,0 +1,10 @@
+//go:build !linux
+
+package transport
+
+import "errors"
+
+// MarkSockets is only supported on Linux.
+func MarkSockets(mark int) error {
+	return errors.New("marking sockets is only supported on linux")
+}
@@ -0,0 +1,119 @@
+package transport
+
+import (
+	"sync"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/omani/nkn-link/config"
+)
+
+// NKN is a Transport backed by a NKN MultiClient. Payloads are sent as raw
+// messages, without sessions.
+type NKN struct {
+	client    *nkn.MultiClient
+	messages  chan *Message
+	onConnect chan *Node
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewNKN creates a new NKN multiclient for the given account and starts
+// forwarding its messages and connect events.
+func NewNKN(conf *config.Config, account *nkn.Account) (*NKN, error) {
+	client, err := conf.NewMultiClient(account, config.IDENTIFIER, 1, true)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &NKN{
+		client:    client,
+		messages:  make(chan *Message, cap(client.OnMessage.C)),
+		onConnect: make(chan *Node, 1),
+		done:      make(chan struct{}),
+	}
+	go t.receive()
+	go t.connect()
+
+	return t, nil
+}
+
+// Client returns the underlying NKN multiclient.
+func (t *NKN) Client() *nkn.MultiClient {
+	return t.client
+}
+
+// Nodes returns the node of every connected subclient.
+func (t *NKN) Nodes() []*Node {
+	return clientNodes(t.client)
+}
+
+// noReply sends tunnel packets without waiting for an ACK of the receiver.
+var noReply = &nkn.MessageConfig{NoReply: true}
+
+func (t *NKN) Send(dst string, data []byte) error {
+	if t.client.IsClosed() {
+		return ErrClosed
+	}
+	// the multiclient returns once the first subclient sent the message,
+	// while the others still use the payload
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	_, err := t.client.Send(nkn.NewStringArray(dst), buf, noReply)
+	return err
+}
+
+func (t *NKN) Receive() <-chan *Message {
+	return t.messages
+}
+
+func (t *NKN) Address() string {
+	return t.client.Address()
+}
+
+func (t *NKN) OnConnect() <-chan *Node {
+	return t.onConnect
+}
+
+func (t *NKN) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+	})
+	return t.client.Close()
+}
+
+// receive forwards messages of the multiclient until it is closed.
+func (t *NKN) receive() {
+	defer close(t.messages)
+	for msg := range t.client.OnMessage.C {
+		select {
+		case t.messages <- &Message{Src: msg.Src, Data: msg.Data}:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// connect forwards connect events of the multiclient until it is closed.
+// Like the multiclient itself, events are dropped if nobody is listening.
+func (t *NKN) connect() {
+	defer close(t.onConnect)
+	for node := range t.client.OnConnect.C {
+		select {
+		case t.onConnect <- &Node{Addr: node.Addr, RPCAddr: node.RPCAddr, Subclient: -1}:
+		default:
+		}
+	}
+}
+
+// clientNodes returns the nodes the subclients of client are connected to.
+func clientNodes(client *nkn.MultiClient) []*Node {
+	var nodes []*Node
+	for i, c := range client.GetClients() {
+		node := c.GetNode()
+		if node == nil {
+			continue
+		}
+		nodes = append(nodes, &Node{Addr: node.Addr, RPCAddr: node.RPCAddr, Subclient: i})
+	}
+	return nodes
+}
@@ -0,0 +1,329 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/omani/nkn-link/config"
+)
+
+const (
+	// sessionHello is exchanged as first frame in both directions of a new
+	// session, so that both peers know they agree on the transport mode.
+	sessionHello = "nkn-link/session/1"
+
+	sessionDialTimeout  = 10 * time.Second
+	sessionHelloTimeout = 10 * time.Second
+	sessionWriteTimeout = 10 * time.Second
+
+	// maxSessionFrame limits the length of a single frame read from a session.
+	maxSessionFrame = 1 << 20
+)
+
+var errBadHello = errors.New("peer did not greet with " + sessionHello + " (is transport_mode set to session on both peers?)")
+
+// Session is a Transport carrying payloads over reliable NKN sessions, one
+// per remote peer. Every payload is sent as a frame prefixed by its length
+// as 32-bit big endian integer.
+//
+// Sessions are dialed on the first Send to a peer. Payloads sent while the
+// session is being dialed are dropped, just like lost messages.
+type Session struct {
+	client    *nkn.MultiClient
+	messages  chan *Message
+	onConnect chan *Node
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu      sync.Mutex
+	closed  bool
+	readers sync.WaitGroup          // goroutines reading from sessions
+	conns   map[string]*sessionConn // established sessions by remote address
+	dialing map[string]bool         // remote addresses currently being dialed
+	warned  map[string]bool         // senders of raw messages already logged
+}
+
+type sessionConn struct {
+	net.Conn
+	wmu sync.Mutex // serializes frames written to the session
+}
+
+// NewSession creates a new NKN multiclient for the given account and accepts
+// sessions from the given peer addresses. If peers is empty, sessions from
+// any address are accepted.
+func NewSession(conf *config.Config, account *nkn.Account, peers []string) (*Session, error) {
+	client, err := conf.NewMultiClient(account, config.IDENTIFIER, 1, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var accept *nkn.StringArray
+	if len(peers) > 0 {
+		accept = nkn.NewStringArray()
+		for _, peer := range peers {
+			accept.Append("^" + regexp.QuoteMeta(peer) + "$")
+		}
+	}
+	err = client.Listen(accept)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	t := &Session{
+		client:    client,
+		messages:  make(chan *Message, cap(client.OnMessage.C)),
+		onConnect: make(chan *Node, 1),
+		done:      make(chan struct{}),
+		conns:     make(map[string]*sessionConn),
+		dialing:   make(map[string]bool),
+		warned:    make(map[string]bool),
+	}
+	go t.accept()
+	go t.drain()
+	go t.connect()
+
+	return t, nil
+}
+
+// Client returns the underlying NKN multiclient.
+func (t *Session) Client() *nkn.MultiClient {
+	return t.client
+}
+
+func (t *Session) Send(dst string, data []byte) error {
+	if t.client.IsClosed() {
+		return ErrClosed
+	}
+
+	t.mu.Lock()
+	conn := t.conns[dst]
+	if conn == nil {
+		if !t.dialing[dst] {
+			t.dialing[dst] = true
+			go t.dial(dst)
+		}
+		t.mu.Unlock()
+		return nil
+	}
+	t.mu.Unlock()
+
+	err := conn.writeFrame(data)
+	if err != nil {
+		log.Printf("Session to %s failed: %v\n", dst, err)
+		t.remove(dst, conn)
+	}
+	return nil
+}
+
+func (t *Session) Receive() <-chan *Message {
+	return t.messages
+}
+
+func (t *Session) Address() string {
+	return t.client.Address()
+}
+
+func (t *Session) OnConnect() <-chan *Node {
+	return t.onConnect
+}
+
+// Nodes returns the node of every connected subclient.
+func (t *Session) Nodes() []*Node {
+	return clientNodes(t.client)
+}
+
+func (t *Session) Close() error {
+	t.closeOnce.Do(func() {
+		t.mu.Lock()
+		t.closed = true
+		for addr, conn := range t.conns {
+			conn.Close()
+			delete(t.conns, addr)
+		}
+		t.mu.Unlock()
+		close(t.done)
+
+		// the channel of received messages is closed once no session
+		// reader is left to send on it
+		go func() {
+			t.readers.Wait()
+			close(t.messages)
+		}()
+	})
+	return t.client.Close()
+}
+
+// dial establishes a session to addr and starts reading from it.
+func (t *Session) dial(addr string) {
+	defer func() {
+		t.mu.Lock()
+		delete(t.dialing, addr)
+		t.mu.Unlock()
+	}()
+
+	session, err := t.client.DialWithConfig(addr, &nkn.DialConfig{
+		DialTimeout: int32(sessionDialTimeout / time.Millisecond),
+	})
+	if err != nil {
+		log.Printf("Could not dial session to %s: %v (is transport_mode set to session on the peer?)\n", addr, err)
+		return
+	}
+
+	conn := &sessionConn{Conn: session}
+	err = conn.greet()
+	if err != nil {
+		log.Printf("Session to %s rejected: %v\n", addr, err)
+		conn.Close()
+		return
+	}
+	t.add(addr, conn)
+}
+
+// accept accepts incoming sessions until the transport is closed.
+func (t *Session) accept() {
+	for {
+		session, err := t.client.AcceptSession()
+		if err != nil {
+			return
+		}
+		go func() {
+			addr := session.RemoteAddr().String()
+			conn := &sessionConn{Conn: session}
+			err := conn.greet()
+			if err != nil {
+				log.Printf("Session from %s rejected: %v\n", addr, err)
+				conn.Close()
+				return
+			}
+			t.add(addr, conn)
+		}()
+	}
+}
+
+// add registers conn as the session to addr and reads from it until it
+// fails.
+func (t *Session) add(addr string, conn *sessionConn) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		conn.Close()
+		return
+	}
+	t.conns[addr] = conn
+	t.readers.Add(1)
+	t.mu.Unlock()
+
+	go func() {
+		defer t.readers.Done()
+		for {
+			data, err := conn.readFrame()
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("Session to %s failed: %v\n", addr, err)
+				}
+				t.remove(addr, conn)
+				return
+			}
+			select {
+			case t.messages <- &Message{Src: addr, Data: data}:
+			case <-t.done:
+				return
+			}
+		}
+	}()
+}
+
+// remove closes conn and forgets it if it is still the session to addr.
+func (t *Session) remove(addr string, conn *sessionConn) {
+	t.mu.Lock()
+	if t.conns[addr] == conn {
+		delete(t.conns, addr)
+	}
+	t.mu.Unlock()
+	conn.Close()
+}
+
+// drain discards raw messages, which are only sent by peers running in
+// message mode, and logs their senders once.
+func (t *Session) drain() {
+	for msg := range t.client.OnMessage.C {
+		t.mu.Lock()
+		warned := t.warned[msg.Src]
+		t.warned[msg.Src] = true
+		t.mu.Unlock()
+		if !warned {
+			log.Printf("Dropping raw message from %s: peer does not use transport_mode session.\n", msg.Src)
+		}
+	}
+}
+
+// connect forwards connect events of the multiclient until it is closed.
+// Like the multiclient itself, events are dropped if nobody is listening.
+func (t *Session) connect() {
+	defer close(t.onConnect)
+	for node := range t.client.OnConnect.C {
+		select {
+		case t.onConnect <- &Node{Addr: node.Addr, RPCAddr: node.RPCAddr, Subclient: -1}:
+		default:
+		}
+	}
+}
+
+// greet exchanges the hello frame with the remote peer.
+func (c *sessionConn) greet() error {
+	err := c.writeFrame([]byte(sessionHello))
+	if err != nil {
+		return err
+	}
+
+	c.SetReadDeadline(time.Now().Add(sessionHelloTimeout))
+	hello, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	c.SetReadDeadline(time.Time{})
+
+	if string(hello) != sessionHello {
+		return errBadHello
+	}
+	return nil
+}
+
+func (c *sessionConn) writeFrame(data []byte) error {
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.SetWriteDeadline(time.Now().Add(sessionWriteTimeout))
+	_, err := c.Write(frame)
+	return err
+}
+
+func (c *sessionConn) readFrame() ([]byte, error) {
+	var header [4]byte
+	_, err := io.ReadFull(c, header[:])
+	if err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n > maxSessionFrame {
+		return nil, fmt.Errorf("frame of %d bytes exceeds limit of %d bytes", n, maxSessionFrame)
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(c, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
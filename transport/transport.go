@@ -0,0 +1,36 @@
+package transport
+
+import "errors"
+
+// ErrClosed is returned when sending on a transport that has been closed.
+var ErrClosed = errors.New("transport closed")
+
+// Message is a payload received from a remote peer.
+type Message struct {
+	Src  string // address of the sending peer
+	Data []byte // payload as it was handed to Send by the remote peer
+}
+
+// Node describes a node of the underlying network the transport is attached to.
+type Node struct {
+	Addr      string // address of the node in host:port format
+	RPCAddr   string // address of the RPC server of the node in host:port format, if any
+	Subclient int    // subclient connected to the node, -1 if unknown
+}
+
+// Transport carries opaque payloads between nkn-link peers. The caller of
+// Send may reuse data once Send returns, so a transport must copy data it
+// still needs afterwards.
+type Transport interface {
+	Send(dst string, data []byte) error // sends data to the peer with address dst
+	Receive() <-chan *Message           // returns the channel of received messages, closed on Close
+	Address() string                    // returns the local address other peers can send to
+	OnConnect() <-chan *Node            // returns the channel of connect events, closed on Close
+	Close() error                       // closes the transport and all its channels
+}
+
+// NodeLister is implemented by transports that can report the nodes they are
+// currently connected to.
+type NodeLister interface {
+	Nodes() []*Node // returns the node of every connected subclient
+}
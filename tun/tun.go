@@ -17,6 +17,14 @@ const (
 	EventMTUUpdate
 )
 
+// Offset is the minimum offset of a packet in the buffers passed to Read and
+// Write. The bytes in front of the packet are used for the headers of the
+// device.
+const Offset = 4
+
+// ipv6Version is the version field of an IPv6 header.
+const ipv6Version = 6
+
 type Device interface {
 	File() *os.File                 // returns the file descriptor of the device
 	Read([]byte, int) (int, error)  // read a packet from the device (without any additional headers)
@@ -221,13 +221,39 @@ func (tun *NativeTun) Read(buff []byte, offset int) (n int, err error) {
 	case err := <-tun.errors:
 		return 0, err
 	default:
-		n, err = tun.tunFile.Read(buff)
+		buff := buff[offset-4:]
+		n, err = tun.tunFile.Read(buff[:])
+		if n < 4 {
+			return 0, err
+		}
+		return n - 4, err
 	}
-	return
 }
 
 func (tun *NativeTun) Write(buff []byte, offset int) (int, error) {
-	return tun.tunFile.Write(buff)
+	// reserve space for header
+
+	buff = buff[offset-4:]
+
+	// add packet information header
+
+	buff[0] = 0x00
+	buff[1] = 0x00
+	buff[2] = 0x00
+
+	if buff[4]>>4 == ipv6Version {
+		buff[3] = unix.AF_INET6
+	} else {
+		buff[3] = unix.AF_INET
+	}
+
+	// write
+
+	n, err := tun.tunFile.Write(buff)
+	if n < 4 {
+		return 0, err
+	}
+	return n - 4, err
 }
 
 func (tun *NativeTun) Flush() error {
@@ -337,14 +337,39 @@ func (tun *NativeTun) Read(buff []byte, offset int) (n int, err error) {
 	case err := <-tun.errors:
 		return 0, err
 	default:
-		n, err = tun.tunFile.Read(buff)
+		buff := buff[offset-4:]
+		n, err = tun.tunFile.Read(buff[:])
+		if n < 4 {
+			return 0, err
+		}
+		return n - 4, err
 	}
-
-	return
 }
 
 func (tun *NativeTun) Write(buf []byte, offset int) (int, error) {
-	return tun.tunFile.Write(buf)
+	// reserve space for header
+
+	buf = buf[offset-4:]
+
+	// add packet information header
+
+	buf[0] = 0x00
+	buf[1] = 0x00
+	buf[2] = 0x00
+
+	if buf[4]>>4 == ipv6Version {
+		buf[3] = unix.AF_INET6
+	} else {
+		buf[3] = unix.AF_INET
+	}
+
+	// write
+
+	n, err := tun.tunFile.Write(buf)
+	if n < 4 {
+		return 0, err
+	}
+	return n - 4, err
 }
 
 func (tun *NativeTun) Flush() error {
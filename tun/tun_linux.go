@@ -327,10 +327,34 @@ func (tun *NativeTun) nameSlow() (string, error) {
 }
 
 func (tun *NativeTun) Write(buf []byte, offset int) (int, error) {
+	if tun.nopi {
+		buf = buf[offset:]
+	} else {
+		// reserve space for header
+		buf = buf[offset-4:]
+
+		// add packet information header
+		buf[0] = 0x00
+		buf[1] = 0x00
+		if buf[4]>>4 == ipv6Version {
+			buf[2] = 0x86
+			buf[3] = 0xdd
+		} else {
+			buf[2] = 0x08
+			buf[3] = 0x00
+		}
+	}
+
 	n, err := tun.tunFile.Write(buf)
 	if errors.Is(err, syscall.EBADFD) {
 		err = os.ErrClosed
 	}
+	if !tun.nopi {
+		n -= 4
+		if n < 0 {
+			n = 0
+		}
+	}
 	return n, err
 }
 
@@ -344,12 +368,18 @@ func (tun *NativeTun) Read(buf []byte, offset int) (n int, err error) {
 	case err = <-tun.errors:
 	default:
 		if tun.nopi {
-			n, err = tun.tunFile.Read(buf)
+			n, err = tun.tunFile.Read(buf[offset:])
 		} else {
-			n, err = tun.tunFile.Read(buf)
+			buf := buf[offset-4:]
+			n, err = tun.tunFile.Read(buf[:])
 			if errors.Is(err, syscall.EBADFD) {
 				err = os.ErrClosed
 			}
+			if n < 4 {
+				n = 0
+			} else {
+				n -= 4
+			}
 		}
 	}
 	return
@@ -379,6 +409,14 @@ func (tun *NativeTun) Close() error {
 }
 
 func CreateTUN(name string, mtu int) (Device, error) {
+	return CreateTUNWithOptions(name, mtu, false)
+}
+
+// CreateTUNWithOptions creates a TUN device like CreateTUN. If nopi is set,
+// the device is created with IFF_NO_PI and the kernel does not prepend the
+// packet information header to the packets. Either way Read and Write only
+// handle bare IP packets.
+func CreateTUNWithOptions(name string, mtu int, nopi bool) (Device, error) {
 	nfd, err := unix.Open(cloneDevicePath, os.O_RDWR, 0)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -389,6 +427,9 @@ func CreateTUN(name string, mtu int) (Device, error) {
 
 	var ifr [ifReqSize]byte
 	var flags uint16 = unix.IFF_TUN // | unix.IFF_NO_PI (disabled for TUN status hack)
+	if nopi {
+		flags |= unix.IFF_NO_PI
+	}
 	nameBytes := []byte(name)
 	if len(nameBytes) >= unix.IFNAMSIZ {
 		unix.Close(nfd)
@@ -417,16 +458,20 @@ func CreateTUN(name string, mtu int) (Device, error) {
 	// Note that the above -- open,ioctl,nonblock -- must happen prior to handing it to netpoll as below this line.
 
 	fd := os.NewFile(uintptr(nfd), cloneDevicePath)
-	return CreateTUNFromFile(fd, mtu)
+	return createTUNFromFile(fd, mtu, nopi)
 }
 
 func CreateTUNFromFile(file *os.File, mtu int) (Device, error) {
+	return createTUNFromFile(file, mtu, false)
+}
+
+func createTUNFromFile(file *os.File, mtu int, nopi bool) (Device, error) {
 	tun := &NativeTun{
 		tunFile:                 file,
 		events:                  make(chan Event, 5),
 		errors:                  make(chan error, 5),
 		statusListenersShutdown: make(chan struct{}),
-		nopi:                    false,
+		nopi:                    nopi,
 	}
 
 	name, err := tun.Name()
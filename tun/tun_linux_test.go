@@ -0,0 +1,83 @@
+package tun
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ipv4Packet = []byte{0x45, 0x00, 0x00, 0x14, 0x00, 0x00, 0x00, 0x00, 0x40, 0x01, 0x00, 0x00, 10, 0, 0, 1, 10, 0, 0, 2}
+	ipv6Packet = append([]byte{0x60, 0x00, 0x00, 0x00, 0x00, 0x00, 0x3b, 0x40}, make([]byte, 32)...)
+)
+
+// newTestTUN returns a device backed by one end of a packet socket pair and
+// the other end, standing in for the kernel.
+func newTestTUN(t *testing.T, nopi bool) (*NativeTun, *os.File) {
+	t.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := os.NewFile(uintptr(fds[0]), "tun")
+	kernel := os.NewFile(uintptr(fds[1]), "kernel")
+	t.Cleanup(func() {
+		dev.Close()
+		kernel.Close()
+	})
+	return &NativeTun{tunFile: dev, nopi: nopi, errors: make(chan error)}, kernel
+}
+
+func TestPacketInformation(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		nopi   bool
+		packet []byte
+		header []byte
+	}{
+		{"ipv4", false, ipv4Packet, []byte{0x00, 0x00, 0x08, 0x00}},
+		{"ipv6", false, ipv6Packet, []byte{0x00, 0x00, 0x86, 0xdd}},
+		{"ipv4 no pi", true, ipv4Packet, nil},
+		{"ipv6 no pi", true, ipv6Packet, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dev, kernel := newTestTUN(t, tc.nopi)
+			frame := append(append([]byte(nil), tc.header...), tc.packet...)
+
+			// the header is added on write
+			buf := make([]byte, Offset+len(tc.packet))
+			copy(buf[Offset:], tc.packet)
+			n, err := dev.Write(buf, Offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(tc.packet) {
+				t.Errorf("Write returned %d, want %d", n, len(tc.packet))
+			}
+			got := make([]byte, 2*len(frame))
+			n, err = kernel.Read(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got[:n], frame) {
+				t.Errorf("device received % x, want % x", got[:n], frame)
+			}
+
+			// and stripped on read
+			_, err = kernel.Write(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf = make([]byte, Offset+1500)
+			n, err = dev.Read(buf, Offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf[Offset:Offset+n], tc.packet) {
+				t.Errorf("Read returned % x, want % x", buf[Offset:Offset+n], tc.packet)
+			}
+		})
+	}
+}
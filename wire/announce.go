@@ -0,0 +1,42 @@
+package wire
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Route announces a node of a mesh and the prefixes routed to it. Every node
+// originates its own route and increases its sequence number whenever it
+// announces it again, so that newer announcements replace older ones.
+type Route struct {
+	Origin    string   `json:"origin"`              // NKN address of the node
+	Seq       uint64   `json:"seq,string"`          // sequence number, increasing with every announcement of the origin
+	Addresses []string `json:"addresses,omitempty"` // IP addresses of the TUN device of the node
+	Subnets   []string `json:"subnets,omitempty"`   // subnets reachable through the node, in CIDR notation
+	Withdrawn bool     `json:"withdrawn,omitempty"` // set if the node left the mesh
+}
+
+// EncodeAnnouncement returns an announcement message carrying routes.
+func EncodeAnnouncement(routes []Route) ([]byte, error) {
+	payload, err := json.Marshal(routes)
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, HeaderLen+len(payload))
+	PutHeader(msg, TypeAnnounce)
+	copy(msg[HeaderLen:], payload)
+	return msg, nil
+}
+
+// ParseAnnouncement returns the routes carried by an announcement message.
+func ParseAnnouncement(msg []byte) ([]Route, error) {
+	if len(msg) < HeaderLen {
+		return nil, ErrShortMessage
+	}
+	var routes []Route
+	err := json.Unmarshal(msg[HeaderLen:], &routes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid announcement: %w", err)
+	}
+	return routes, nil
+}
@@ -0,0 +1,91 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// MaxBatchedPacket is the length of the largest packet that fits into a batch.
+const MaxBatchedPacket = 0xffff
+
+// batchLenSize is the size of the length prefixing every packet in a batch.
+const batchLenSize = 2
+
+var ErrPacketTooLarge = errors.New("packet too large for batch")
+
+// Batch builds a message of type TypeBatch. The payload of a batch is a
+// sequence of packets, each prefixed by its length as 16-bit big endian
+// integer.
+type Batch struct {
+	buf   []byte
+	count int
+}
+
+// NewBatch returns an empty batch with room for size bytes.
+func NewBatch(size int) *Batch {
+	b := &Batch{
+		buf: make([]byte, HeaderLen, HeaderLen+size),
+	}
+	PutHeader(b.buf, TypeBatch)
+	return b
+}
+
+// Add appends a copy of packet to the batch.
+func (b *Batch) Add(packet []byte) error {
+	if len(packet) > MaxBatchedPacket {
+		return ErrPacketTooLarge
+	}
+	var n [batchLenSize]byte
+	binary.BigEndian.PutUint16(n[:], uint16(len(packet)))
+	b.buf = append(b.buf, n[:]...)
+	b.buf = append(b.buf, packet...)
+	b.count++
+	return nil
+}
+
+// Count returns the number of packets in the batch.
+func (b *Batch) Count() int {
+	return b.count
+}
+
+// Len returns the length of the encoded batch message.
+func (b *Batch) Len() int {
+	return len(b.buf)
+}
+
+// Grow returns the length of the encoded batch message after adding a packet
+// of length n.
+func (b *Batch) Grow(n int) int {
+	return len(b.buf) + batchLenSize + n
+}
+
+// Bytes returns the encoded batch message. It is only valid until the next
+// call to Add or Reset.
+func (b *Batch) Bytes() []byte {
+	return b.buf
+}
+
+// Reset empties the batch.
+func (b *Batch) Reset() {
+	b.buf = b.buf[:HeaderLen]
+	b.count = 0
+}
+
+func decodeBatch(payload []byte, fn func(packet []byte) error) error {
+	for len(payload) > 0 {
+		if len(payload) < batchLenSize {
+			return ErrShortMessage
+		}
+		n := int(binary.BigEndian.Uint16(payload))
+		payload = payload[batchLenSize:]
+		if len(payload) < n {
+			return ErrShortMessage
+		}
+		err := fn(payload[:n])
+		if err != nil {
+			return err
+		}
+		payload = payload[n:]
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package wire
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// codecs
+const (
+	CodecNone    byte = 0x00 // payload is not compressed
+	CodecDeflate byte = 0x01 // payload is compressed with deflate (RFC 1951)
+)
+
+// codecMask selects the codec from the flags of a message.
+const codecMask = 0x0f
+
+// MaxDecompressed limits the length of a decompressed payload.
+const MaxDecompressed = 1 << 20
+
+var deflaters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// ParseCodec returns the codec with the given name. The empty string and
+// "none" stand for no compression.
+func ParseCodec(name string) (byte, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return CodecNone, nil
+	case "deflate":
+		return CodecDeflate, nil
+	default:
+		return 0, fmt.Errorf("unknown compression %q", name)
+	}
+}
+
+// CodecName returns the name of codec as accepted by ParseCodec.
+func CodecName(codec byte) string {
+	switch codec {
+	case CodecNone:
+		return "none"
+	case CodecDeflate:
+		return "deflate"
+	default:
+		return fmt.Sprintf("codec(%d)", codec)
+	}
+}
+
+// Compress returns msg with its payload compressed by codec. If the payload
+// does not shrink, msg is returned unchanged.
+func Compress(msg []byte, codec byte) []byte {
+	if codec == CodecNone || len(msg) <= HeaderLen {
+		return msg
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(msg))
+	buf.Write(msg[:HeaderLen])
+
+	switch codec {
+	case CodecDeflate:
+		w := deflaters.Get().(*flate.Writer)
+		w.Reset(&buf)
+		w.Write(msg[HeaderLen:])
+		w.Close()
+		deflaters.Put(w)
+	default:
+		return msg
+	}
+
+	if buf.Len() >= len(msg) {
+		return msg
+	}
+	compressed := buf.Bytes()
+	compressed[offFlags] = compressed[offFlags]&^codecMask | codec
+	return compressed
+}
+
+// decompress returns msg with its payload decompressed and its codec reset.
+func decompress(msg []byte) ([]byte, error) {
+	var r io.Reader
+	switch msg[offFlags] & codecMask {
+	case CodecDeflate:
+		r = flate.NewReader(bytes.NewReader(msg[HeaderLen:]))
+	default:
+		return nil, ErrUnknownCodec
+	}
+
+	payload, err := ioutil.ReadAll(io.LimitReader(r, MaxDecompressed+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %w", err)
+	}
+	if len(payload) > MaxDecompressed {
+		return nil, fmt.Errorf("decompress: payload exceeds %d bytes", MaxDecompressed)
+	}
+
+	out := make([]byte, HeaderLen+len(payload))
+	copy(out, msg[:HeaderLen])
+	out[offFlags] &^= codecMask
+	copy(out[HeaderLen:], payload)
+	return out, nil
+}
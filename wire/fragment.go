@@ -0,0 +1,73 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// FragmentHeaderLen is the length of the fragment header following the
+// message header of every fragment.
+const FragmentHeaderLen = 6
+
+// MaxFragments is the maximum number of fragments a message can be split into.
+const MaxFragments = 0xff
+
+var ErrTooManyFragments = errors.New("message needs too many fragments")
+
+// FragmentHeader identifies a fragment of a message. The payload of a
+// fragment message is the fragment header followed by a slice of the
+// original message, including its header:
+//
+//	ID    uint32, big endian, same for all fragments of a message
+//	Index uint8, position of the fragment, starting at 0
+//	Count uint8, number of fragments of the message
+type FragmentHeader struct {
+	ID    uint32
+	Index uint8
+	Count uint8
+}
+
+// Fragment splits msg into fragment messages of at most size bytes each.
+func Fragment(msg []byte, id uint32, size int) ([][]byte, error) {
+	chunk := size - HeaderLen - FragmentHeaderLen
+	if chunk <= 0 {
+		return nil, errors.New("fragment size too small")
+	}
+	count := (len(msg) + chunk - 1) / chunk
+	if count > MaxFragments {
+		return nil, ErrTooManyFragments
+	}
+
+	fragments := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		data := msg[i*chunk:]
+		if len(data) > chunk {
+			data = data[:chunk]
+		}
+		frag := make([]byte, HeaderLen+FragmentHeaderLen+len(data))
+		PutHeader(frag, TypeFragment)
+		binary.BigEndian.PutUint32(frag[HeaderLen:], id)
+		frag[HeaderLen+4] = uint8(i)
+		frag[HeaderLen+5] = uint8(count)
+		copy(frag[HeaderLen+FragmentHeaderLen:], data)
+		fragments = append(fragments, frag)
+	}
+	return fragments, nil
+}
+
+// ParseFragment returns the fragment header and the data of a fragment
+// message. The data shares the memory of msg.
+func ParseFragment(msg []byte) (FragmentHeader, []byte, error) {
+	if len(msg) < HeaderLen+FragmentHeaderLen {
+		return FragmentHeader{}, nil, ErrShortMessage
+	}
+	h := FragmentHeader{
+		ID:    binary.BigEndian.Uint32(msg[HeaderLen:]),
+		Index: msg[HeaderLen+4],
+		Count: msg[HeaderLen+5],
+	}
+	if h.Count == 0 || h.Index >= h.Count {
+		return FragmentHeader{}, nil, errors.New("invalid fragment header")
+	}
+	return h, msg[HeaderLen+FragmentHeaderLen:], nil
+}
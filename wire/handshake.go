@@ -0,0 +1,78 @@
+package wire
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// features a peer can receive
+const (
+	FeatureBatch    = "batch"    // messages of type TypeBatch
+	FeatureFragment = "fragment" // messages of type TypeFragment
+	FeatureDeflate  = "deflate"  // payloads compressed with CodecDeflate
+)
+
+// Features returns the features supported by this package.
+func Features() []string {
+	return []string{FeatureBatch, FeatureFragment, FeatureDeflate}
+}
+
+// Handshake is the payload of a handshake message, encoded as JSON. A peer
+// sends a handshake when it starts or lost contact to the other peer, which
+// answers with its own handshake marked as reply. A handshake carrying an
+// error rejects the handshake received before and is never answered.
+type Handshake struct {
+	Reply     bool     `json:"reply,omitempty"`
+	Version   int      `json:"version"`             // version of the wire format
+	MTU       int      `json:"mtu"`                 // MTU of the TUN device
+	Features  []string `json:"features"`            // features the sender can receive
+	Addresses []string `json:"addresses,omitempty"` // IP addresses of the TUN device
+	Subnets   []string `json:"subnets,omitempty"`   // subnets reachable through the sender, in CIDR notation
+	Lease     []string `json:"lease,omitempty"`     // addresses a server assigns to the receiver, in CIDR notation
+	Profile   *Profile `json:"profile,omitempty"`   // configuration a server pushes to the receiver
+	Error     string   `json:"error,omitempty"`     // why the sender rejects the handshake of the receiver
+}
+
+// Profile is the configuration a server pushes to its clients along with
+// their lease.
+type Profile struct {
+	MTU          int      `json:"mtu,omitempty"`           // MTU of the TUN device
+	Routes       []string `json:"routes,omitempty"`        // prefixes routed through the tunnel
+	DNS          []string `json:"dns,omitempty"`           // DNS servers
+	DefaultRoute bool     `json:"default_route,omitempty"` // route all traffic through the tunnel
+}
+
+// Has reports whether the sender of h supports feature.
+func (h *Handshake) Has(feature string) bool {
+	for _, f := range h.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// EncodeHandshake returns a handshake message.
+func EncodeHandshake(h *Handshake) ([]byte, error) {
+	payload, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, HeaderLen+len(payload))
+	PutHeader(msg, TypeHandshake)
+	copy(msg[HeaderLen:], payload)
+	return msg, nil
+}
+
+// ParseHandshake returns the handshake carried by a handshake message.
+func ParseHandshake(msg []byte) (*Handshake, error) {
+	if len(msg) < HeaderLen {
+		return nil, ErrShortMessage
+	}
+	h := &Handshake{}
+	err := json.Unmarshal(msg[HeaderLen:], h)
+	if err != nil {
+		return nil, fmt.Errorf("invalid handshake: %w", err)
+	}
+	return h, nil
+}
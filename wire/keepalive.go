@@ -0,0 +1,40 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// KeepaliveLen is the length of a keepalive message.
+const KeepaliveLen = HeaderLen + 9
+
+// keepalive kinds
+const (
+	KeepalivePing byte = 0x00 // asks the peer to answer with a pong
+	KeepalivePong byte = 0x01 // answers a ping, echoing its stamp
+)
+
+// Keepalive returns a keepalive message. The payload of a keepalive message
+// is its kind followed by a stamp chosen by the sender of the ping:
+//
+//	Kind  uint8, KeepalivePing or KeepalivePong
+//	Stamp uint64, big endian, echoed unchanged in the pong
+func Keepalive(kind byte, stamp uint64) []byte {
+	msg := make([]byte, KeepaliveLen)
+	PutHeader(msg, TypeKeepalive)
+	msg[HeaderLen] = kind
+	binary.BigEndian.PutUint64(msg[HeaderLen+1:], stamp)
+	return msg
+}
+
+// ParseKeepalive returns the kind and the stamp of a keepalive message.
+func ParseKeepalive(msg []byte) (byte, uint64, error) {
+	if len(msg) < KeepaliveLen {
+		return 0, 0, ErrShortMessage
+	}
+	kind := msg[HeaderLen]
+	if kind != KeepalivePing && kind != KeepalivePong {
+		return 0, 0, errors.New("invalid keepalive kind")
+	}
+	return kind, binary.BigEndian.Uint64(msg[HeaderLen+1:]), nil
+}
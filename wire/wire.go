@@ -0,0 +1,93 @@
+// Package wire implements the format of the messages exchanged between
+// nkn-link peers.
+//
+// Every message starts with a header of HeaderLen bytes. The first byte of the
+// header is the version of the wire format, messages of any other version than
+// Version are rejected. The second byte is the type of the message, which
+// determines the format of the payload following the header. The third byte
+// holds flags, of which the lower four bits name the codec the payload is
+// compressed with.
+//
+// The format is specified in docs/wire-format.md.
+package wire
+
+import (
+	"errors"
+	"fmt"
+)
+
+// HeaderLen is the length of the header of every message.
+const HeaderLen = 3
+
+// Version is the version of the wire format implemented by this package.
+const Version byte = 0x01
+
+// offsets of the header fields
+const (
+	offVersion = 0
+	offType    = 1
+	offFlags   = 2
+)
+
+// message types
+const (
+	TypePacket    byte = 0x01 // payload is a single IP packet
+	TypeBatch     byte = 0x02 // payload is a batch of IP packets
+	TypeFragment  byte = 0x03 // payload is a fragment of a larger message
+	TypeKeepalive byte = 0x04 // control message probing the liveness of the peer
+	TypeHandshake byte = 0x05 // control message negotiating the capabilities of the peers
+	TypeAnnounce  byte = 0x06 // control message announcing routes of a mesh
+)
+
+var (
+	ErrShortMessage   = errors.New("message too short")
+	ErrUnknownVersion = errors.New("unknown wire format version")
+	ErrUnknownType    = errors.New("unknown message type")
+	ErrUnknownCodec   = errors.New("unknown codec")
+)
+
+// PutHeader writes the header of an uncompressed message of type typ to the
+// beginning of buf, which must be at least HeaderLen bytes long.
+func PutHeader(buf []byte, typ byte) {
+	buf[offVersion] = Version
+	buf[offType] = typ
+	buf[offFlags] = CodecNone
+}
+
+// Type returns the type of msg. It fails if msg is shorter than the header or
+// of an unknown version.
+func Type(msg []byte) (byte, error) {
+	if len(msg) < HeaderLen {
+		return 0, ErrShortMessage
+	}
+	if msg[offVersion] != Version {
+		return 0, fmt.Errorf("%w %d", ErrUnknownVersion, msg[offVersion])
+	}
+	return msg[offType], nil
+}
+
+// Decode calls fn for every IP packet contained in msg. The packets passed to
+// fn share the memory of msg. Fragments must be reassembled before they can
+// be decoded, control messages are not decoded.
+func Decode(msg []byte, fn func(packet []byte) error) error {
+	typ, err := Type(msg)
+	if err != nil {
+		return err
+	}
+
+	if msg[offFlags]&codecMask != CodecNone {
+		msg, err = decompress(msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch typ {
+	case TypePacket:
+		return fn(msg[HeaderLen:])
+	case TypeBatch:
+		return decodeBatch(msg[HeaderLen:], fn)
+	default:
+		return ErrUnknownType
+	}
+}
@@ -0,0 +1,216 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// the test vectors of docs/wire-format.md
+
+const vectorIP = "45 00 00 14 00 00 00 00 40 01 00 00 0a 00 00 01 0a 00 00 02"
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// decodeAll returns the packets decoded from msg.
+func decodeAll(t *testing.T, msg []byte) [][]byte {
+	t.Helper()
+	var packets [][]byte
+	err := Decode(msg, func(packet []byte) error {
+		packets = append(packets, append([]byte(nil), packet...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packets
+}
+
+func TestVectorPacket(t *testing.T) {
+	ip := unhex(t, vectorIP)
+	want := unhex(t, "01 01 00 "+vectorIP)
+
+	msg := make([]byte, HeaderLen+len(ip))
+	PutHeader(msg, TypePacket)
+	copy(msg[HeaderLen:], ip)
+	if !bytes.Equal(msg, want) {
+		t.Errorf("encoded %x, want %x", msg, want)
+	}
+
+	packets := decodeAll(t, want)
+	if len(packets) != 1 || !bytes.Equal(packets[0], ip) {
+		t.Errorf("decoded %x, want [%x]", packets, ip)
+	}
+}
+
+func TestVectorBatch(t *testing.T) {
+	want := unhex(t, "01 02 00 00 04 45 00 00 14 00 02 45 00")
+	first, second := unhex(t, "45 00 00 14"), unhex(t, "45 00")
+
+	b := NewBatch(16)
+	for _, packet := range [][]byte{first, second} {
+		if err := b.Add(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("encoded %x, want %x", b.Bytes(), want)
+	}
+
+	packets := decodeAll(t, want)
+	if len(packets) != 2 || !bytes.Equal(packets[0], first) || !bytes.Equal(packets[1], second) {
+		t.Errorf("decoded %x, want [%x %x]", packets, first, second)
+	}
+}
+
+func TestVectorFragment(t *testing.T) {
+	msg := unhex(t, "01 01 00 "+vectorIP)
+	want := [][]byte{
+		unhex(t, "01 03 00 00 00 00 07 00 04 01 01 00 45 00 00 14"),
+		unhex(t, "01 03 00 00 00 00 07 01 04 00 00 00 00 40 01 00"),
+		unhex(t, "01 03 00 00 00 00 07 02 04 00 0a 00 00 01 0a 00"),
+		unhex(t, "01 03 00 00 00 00 07 03 04 00 02"),
+	}
+
+	fragments, err := Fragment(msg, 7, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fragments) != len(want) {
+		t.Fatalf("got %d fragments, want %d", len(fragments), len(want))
+	}
+
+	var joined []byte
+	for i, frag := range fragments {
+		if !bytes.Equal(frag, want[i]) {
+			t.Errorf("fragment %d is %x, want %x", i, frag, want[i])
+		}
+		h, data, err := ParseFragment(want[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.ID != 7 || int(h.Index) != i || int(h.Count) != len(want) {
+			t.Errorf("fragment %d has header %+v", i, h)
+		}
+		joined = append(joined, data...)
+	}
+	if !bytes.Equal(joined, msg) {
+		t.Errorf("joined fragments %x, want %x", joined, msg)
+	}
+}
+
+func TestVectorKeepalive(t *testing.T) {
+	const stamp = 0x0102030405060708
+	for _, v := range []struct {
+		kind byte
+		msg  string
+	}{
+		{KeepalivePing, "01 04 00 00 01 02 03 04 05 06 07 08"},
+		{KeepalivePong, "01 04 00 01 01 02 03 04 05 06 07 08"},
+	} {
+		want := unhex(t, v.msg)
+		if msg := Keepalive(v.kind, stamp); !bytes.Equal(msg, want) {
+			t.Errorf("encoded %x, want %x", msg, want)
+		}
+		kind, s, err := ParseKeepalive(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind != v.kind || s != stamp {
+			t.Errorf("decoded kind %d stamp %#x, want kind %d stamp %#x", kind, s, v.kind, uint64(stamp))
+		}
+	}
+}
+
+func TestVectorDeflate(t *testing.T) {
+	want := bytes.Repeat([]byte{0xaa}, 256)
+
+	packets := decodeAll(t, unhex(t, "01 01 01 5a b5 6a 64 43 c0 00"))
+	if len(packets) != 1 || !bytes.Equal(packets[0], want) {
+		t.Errorf("decoded %x, want [%x]", packets, want)
+	}
+
+	msg := make([]byte, HeaderLen+len(want))
+	PutHeader(msg, TypePacket)
+	copy(msg[HeaderLen:], want)
+	compressed := Compress(msg, CodecDeflate)
+	if len(compressed) >= len(msg) {
+		t.Fatalf("payload did not shrink: %d bytes", len(compressed))
+	}
+	packets = decodeAll(t, compressed)
+	if len(packets) != 1 || !bytes.Equal(packets[0], want) {
+		t.Errorf("round trip decoded %x, want [%x]", packets, want)
+	}
+}
+
+func TestVectorHandshake(t *testing.T) {
+	want := append(unhex(t, "01 05 00"),
+		`{"version":1,"mtu":1420,"features":["batch","fragment","deflate"],"addresses":["10.0.0.1"]}`...)
+
+	h, err := ParseHandshake(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != 1 || h.MTU != 1420 || len(h.Addresses) != 1 || h.Addresses[0] != "10.0.0.1" {
+		t.Errorf("decoded %+v", h)
+	}
+	for _, feature := range []string{FeatureBatch, FeatureFragment, "deflate"} {
+		if !h.Has(feature) {
+			t.Errorf("feature %s missing", feature)
+		}
+	}
+
+	msg, err := EncodeHandshake(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, want) {
+		t.Errorf("encoded %q, want %q", msg, want)
+	}
+}
+
+func TestVectorAnnounce(t *testing.T) {
+	want := append(unhex(t, "01 06 00"),
+		`[{"origin":"node.2b1c","seq":"9223372036854775809","addresses":["10.0.0.1"],"subnets":["192.168.1.0/24"]}]`...)
+
+	routes, err := ParseAnnouncement(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || routes[0].Origin != "node.2b1c" || routes[0].Seq != 1<<63+1 ||
+		len(routes[0].Addresses) != 1 || len(routes[0].Subnets) != 1 || routes[0].Withdrawn {
+		t.Fatalf("decoded %+v", routes)
+	}
+
+	msg, err := EncodeAnnouncement(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, want) {
+		t.Errorf("encoded %q, want %q", msg, want)
+	}
+}
+
+func TestVectorUnknownVersion(t *testing.T) {
+	msg := unhex(t, "02 01 00 "+vectorIP)
+
+	if _, err := Type(msg); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("Type returned %v, want %v", err, ErrUnknownVersion)
+	}
+	err := Decode(msg, func(packet []byte) error {
+		t.Error("packet decoded from a message of version 2")
+		return nil
+	})
+	if !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("Decode returned %v, want %v", err, ErrUnknownVersion)
+	}
+}